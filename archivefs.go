@@ -0,0 +1,270 @@
+package tarsnap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only file system view of the specified archive.
+//
+// The directory structure of the file system is loaded from the entries of
+// the archive when FS is called. The contents of each file are fetched from
+// tarsnap as the file is read, so that only the files actually read are
+// transferred.
+func (c *Config) FS(name string) (*ArchiveFS, error) {
+	return c.FSContext(context.Background(), name)
+}
+
+// FSContext is as FS, but the tarsnap process that lists the archive is
+// interrupted if ctx ends before it completes. The context does not govern
+// reads from the resulting file system.
+func (c *Config) FSContext(ctx context.Context, name string) (*ArchiveFS, error) {
+	afs := &ArchiveFS{
+		c:    c,
+		name: name,
+		root: &fsNode{isDir: true, children: make(map[string]*fsNode)},
+	}
+	if err := c.EntriesContext(ctx, name, func(e *Entry) error {
+		afs.add(e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return afs, nil
+}
+
+// ArchiveFS is a read-only view of the contents of an archive. It implements
+// the fs.FS, fs.StatFS, and fs.ReadDirFS interfaces.
+//
+// The names in the file system are the names of the entries in the archive,
+// with any leading "/" or "./" removed. Directories that are not themselves
+// stored in the archive, but which contain stored entries, are synthesized.
+type ArchiveFS struct {
+	c    *Config
+	name string
+	root *fsNode
+}
+
+// An fsNode is a single file or directory in an ArchiveFS.
+type fsNode struct {
+	name  string // the base name of the node
+	entry *Entry // the archive entry, or nil for a synthesized directory
+	data  *Entry // the entry holding the contents, which differs for a hard link
+	isDir bool
+
+	children map[string]*fsNode // for directories
+}
+
+// cleanEntryName converts an archive entry name to a file system path.
+func cleanEntryName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+// add adds an entry to the tree of afs, creating parent directories as
+// needed.
+func (afs *ArchiveFS) add(e *Entry) {
+	p := cleanEntryName(e.Name)
+	if p == "." {
+		afs.root.entry, afs.root.data = e, e
+		return
+	}
+	dir := afs.root
+	parts := strings.Split(p, "/")
+	for _, part := range parts[:len(parts)-1] {
+		next := dir.children[part]
+		if next == nil || !next.isDir {
+			next = &fsNode{name: part, isDir: true, children: make(map[string]*fsNode)}
+			dir.children[part] = next
+		}
+		dir = next
+	}
+	base := parts[len(parts)-1]
+	node := dir.children[base]
+	if node == nil {
+		node = &fsNode{name: base}
+		dir.children[base] = node
+	}
+	node.entry, node.data = e, e
+	node.isDir = e.Mode.IsDir()
+
+	// A hard link shares the contents of its target, which precedes it in the
+	// archive.
+	if e.HardLinkTo != "" {
+		if t, err := afs.lookup("open", cleanEntryName(e.HardLinkTo)); err == nil && t.entry != nil {
+			node.data = t.data
+		}
+	}
+	if node.isDir && node.children == nil {
+		node.children = make(map[string]*fsNode)
+	} else if !node.isDir {
+		node.children = nil
+	}
+}
+
+// lookup finds the node for the specified path.
+func (afs *ArchiveFS) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	cur := afs.root
+	if name == "." {
+		return cur, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// Open implements the fs.FS interface.
+func (afs *ArchiveFS) Open(name string) (fs.File, error) {
+	node, err := afs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.isDir {
+		return &fsDir{info: node.info(), entries: node.dirEntries()}, nil
+	}
+	return &fsFile{afs: afs, node: node}, nil
+}
+
+// Stat implements the fs.StatFS interface.
+func (afs *ArchiveFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := afs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+// ReadDir implements the fs.ReadDirFS interface.
+func (afs *ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := afs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	} else if !node.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return node.dirEntries(), nil
+}
+
+func (n *fsNode) info() fs.FileInfo { return fileInfo{n} }
+
+// dirEntries returns the children of n ordered by name.
+func (n *fsNode) dirEntries() []fs.DirEntry {
+	out := make([]fs.DirEntry, 0, len(n.children))
+	for _, kid := range n.children {
+		out = append(out, fs.FileInfoToDirEntry(kid.info()))
+	}
+	slices.SortFunc(out, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return out
+}
+
+// fileInfo implements the fs.FileInfo interface for an fsNode.
+type fileInfo struct{ n *fsNode }
+
+func (fi fileInfo) Name() string {
+	if fi.n.name == "" {
+		return "."
+	}
+	return fi.n.name
+}
+
+func (fi fileInfo) Size() int64 {
+	if fi.n.data == nil {
+		return 0
+	}
+	return fi.n.data.Size
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.n.entry == nil {
+		return fs.ModeDir | 0555
+	}
+	return fi.n.entry.Mode
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	if fi.n.entry == nil {
+		return time.Time{}
+	}
+	return fi.n.entry.ModTime
+}
+
+func (fi fileInfo) IsDir() bool { return fi.n.isDir }
+
+// Sys returns the *Entry for the file, or nil for a synthesized directory.
+func (fi fileInfo) Sys() any { return fi.n.entry }
+
+// fsDir implements the fs.ReadDirFile interface for a directory.
+type fsDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	} else if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(n, len(rest))]
+	d.pos += len(rest)
+	return rest, nil
+}
+
+// fsFile implements the fs.File interface for a non-directory. The contents of
+// the file are fetched when it is first read.
+type fsFile struct {
+	afs  *ArchiveFS
+	node *fsNode
+	rc   io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.node.info(), nil }
+
+func (f *fsFile) Read(data []byte) (int, error) {
+	if !f.node.data.Mode.IsRegular() {
+		return 0, io.EOF // only regular files have contents
+	} else if f.rc == nil {
+		rc, err := f.afs.c.Open(f.afs.name, f.node.data.Name)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	return f.rc.Read(data)
+}
+
+func (f *fsFile) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	err := f.rc.Close()
+	f.rc = nil
+	return err
+}
@@ -0,0 +1,376 @@
+// Program tarsnapctl is a scriptable front end to the tarsnap command-line
+// tool. It reports the results of each operation as JSON, using the data
+// structures of the github.com/creachadair/tarsnap package.
+//
+// Usage:
+//
+//	tarsnapctl [flags] <command> [args...]
+//
+// The commands are:
+//
+//	list      list archives, optionally filtered
+//	entries   list the entries of an archive, one JSON object per line
+//	diff      report the differences between the entries of two archives
+//	size      report storage sizes for all archives or the named archives
+//	prune     delete archives not retained by a retention policy
+//	plan run  create the archives of a backup plan
+//	plan prune  apply the retention policies of a backup plan
+//
+// Run "tarsnapctl <command> -help" for the flags of each command.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+)
+
+var (
+	toolName  = flag.String("tool", "", "Name or path of the tarsnap tool (default tarsnap)")
+	keyFile   = flag.String("keyfile", "", "Path of the tarsnap key file")
+	cacheDir  = flag.String("cachedir", "", "Path of the tarsnap cache directory")
+	listCache = flag.String("list-cache", "", "If set, cache archive lists in this file")
+	naming    = flag.String("naming", "", "If set, parse archive names with this template")
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %[1]s [flags] <command> [args...]
+
+Run tarsnap operations and report their results as JSON.
+
+Commands:
+  list [-base b] [-match glob] [-regexp re] [-after t] [-before t] [-latest n]
+  entries <archive>
+  diff <old-archive> <new-archive>
+  size [archive...]
+  prune [-dry-run] [-policy file | -keep-last n -daily n ...]
+  plan run <plan-file>
+  plan prune [-dry-run] <plan-file>
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg := &tarsnap.Config{
+		Tool:      *toolName,
+		Keyfile:   *keyFile,
+		CacheDir:  *cacheDir,
+		ListCache: *listCache,
+	}
+	if *naming != "" {
+		t, err := tarsnap.ParseTemplate(*naming)
+		if err != nil {
+			fatalf("Invalid -naming: %v", err)
+		}
+		cfg.Naming = t
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := runCommand(ctx, cfg, flag.Args(), os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(msg string, args ...any) {
+	fmt.Fprintf(os.Stderr, "tarsnapctl: "+msg+"\n", args...)
+	os.Exit(1)
+}
+
+// runCommand runs the command described by args with cfg, and writes its
+// output to w.
+func runCommand(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	name, rest := args[0], args[1:]
+	switch name {
+	case "list":
+		return runList(ctx, cfg, rest, w)
+	case "entries":
+		return runEntries(ctx, cfg, rest, w)
+	case "diff":
+		return runDiff(ctx, cfg, rest, w)
+	case "size":
+		return runSize(ctx, cfg, rest, w)
+	case "prune":
+		return runPrune(ctx, cfg, rest, w)
+	case "plan":
+		return runPlan(ctx, cfg, rest, w)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// newFlags returns a flag set for the named command, whose usage message
+// describes the positional arguments in argUsage.
+func newFlags(name, argUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tarsnapctl %s [flags] %s\n", name, argUsage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of fs from args, and checks that the number of
+// remaining arguments is between lo and hi inclusive, or at least lo if hi
+// is negative.
+func parseArgs(fs *flag.FlagSet, args []string, lo, hi int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if n := fs.NArg(); n < lo || (hi >= 0 && n > hi) {
+		fs.Usage()
+		return fmt.Errorf("%s: wrong number of arguments", fs.Name())
+	}
+	return nil
+}
+
+// timeFlag is a flag.Value for a time in RFC 3339 format or a date.
+type timeFlag struct{ time.Time }
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(s string) error {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if v, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			t.Time = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q (use RFC 3339 or YYYY-MM-DD)", s)
+}
+
+func runList(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	fs := newFlags("list", "")
+	base := fs.String("base", "", "List only archives with this base")
+	match := fs.String("match", "", "List only archives whose names match this glob")
+	reText := fs.String("regexp", "", "List only archives whose names match this regular expression")
+	latest := fs.Int("latest", 0, "List only the latest n complete archives of each base")
+	var after, before timeFlag
+	fs.Var(&after, "after", "List only archives created after this time")
+	fs.Var(&before, "before", "List only archives created before this time")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	if *reText != "" {
+		var err error
+		re, err = regexp.Compile(*reText)
+		if err != nil {
+			return fmt.Errorf("invalid -regexp: %w", err)
+		}
+	}
+
+	archs, err := cfg.ListContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !after.IsZero() {
+		archs = archs.After(after.Time)
+	}
+	if !before.IsZero() {
+		archs = archs.Before(before.Time)
+	}
+	if *base != "" {
+		archs = archs.Filter(func(a tarsnap.Archive) bool { return a.Base == *base })
+	}
+	if *match != "" {
+		archs, err = archs.Match(*match)
+		if err != nil {
+			return fmt.Errorf("invalid -match: %w", err)
+		}
+	}
+	if re != nil {
+		archs = archs.MatchRegexp(re)
+	}
+	if *latest > 0 {
+		keep := make(map[string]bool)
+		for _, b := range archs.Bases() {
+			for _, a := range archs.LatestN(b, *latest) {
+				keep[a.Name] = true
+			}
+		}
+		archs = archs.Filter(func(a tarsnap.Archive) bool { return keep[a.Name] })
+	}
+	if archs == nil {
+		archs = tarsnap.Archives{} // report an empty list as [], not null
+	}
+	return writeJSON(w, archs)
+}
+
+func runEntries(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	fs := newFlags("entries", "<archive>")
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	return cfg.EntriesContext(ctx, fs.Arg(0), func(e *tarsnap.Entry) error {
+		return enc.Encode(e)
+	})
+}
+
+func runDiff(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	fs := newFlags("diff", "<old-archive> <new-archive>")
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+	d, err := cfg.DiffContext(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if d.Changes == nil {
+		d.Changes = []tarsnap.Change{}
+	}
+	return writeJSON(w, d)
+}
+
+func runSize(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	fs := newFlags("size", "[archive...]")
+	if err := parseArgs(fs, args, 0, -1); err != nil {
+		return err
+	}
+	info, err := cfg.SizeContext(ctx, fs.Args()...)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, info)
+}
+
+func runPrune(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	fs := newFlags("prune", "")
+	dryRun := fs.Bool("dry-run", false, "Report the archives to delete without deleting them")
+	policyFile := fs.String("policy", "", "Read the retention policy from this JSON file")
+	var p tarsnap.Policy
+	fs.IntVar(&p.KeepLast, "keep-last", 0, "Keep the latest n archives of each base")
+	fs.IntVar(&p.Hourly, "hourly", 0, "Keep the latest archive of each of n hours")
+	fs.IntVar(&p.Daily, "daily", 0, "Keep the latest archive of each of n days")
+	fs.IntVar(&p.Weekly, "weekly", 0, "Keep the latest archive of each of n weeks")
+	fs.IntVar(&p.Monthly, "monthly", 0, "Keep the latest archive of each of n months")
+	fs.IntVar(&p.Yearly, "yearly", 0, "Keep the latest archive of each of n years")
+	fs.Var(&p.MinAge, "min-age", "Never delete archives younger than this")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *policyFile != "" {
+		var conflict []string
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name != "policy" && f.Name != "dry-run" {
+				conflict = append(conflict, "-"+f.Name)
+			}
+		})
+		if len(conflict) != 0 {
+			return fmt.Errorf("prune: -policy cannot be combined with %s", strings.Join(conflict, ", "))
+		}
+		var err error
+		p, err = loadPolicy(*policyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	rep, err := cfg.PruneContext(ctx, p, *dryRun)
+	if rep != nil {
+		if werr := writeJSON(w, rep); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// loadPolicy reads a JSON retention policy from the specified file. As in a
+// plan, durations are strings such as "36h", and unknown fields are errors.
+func loadPolicy(path string) (tarsnap.Policy, error) {
+	var p tarsnap.Policy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return p, fmt.Errorf("policy %q: %w", path, err)
+	}
+	return p, nil
+}
+
+func runPlan(ctx context.Context, cfg *tarsnap.Config, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("plan: missing subcommand (run or prune)")
+	}
+	switch args[0] {
+	case "run":
+		fs := newFlags("plan run", "<plan-file>")
+		if err := parseArgs(fs, args[1:], 1, 1); err != nil {
+			return err
+		}
+		plan, err := tarsnap.LoadPlan(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		res, err := plan.RunContext(ctx, cfg)
+		if res != nil {
+			if werr := writeJSON(w, res); err == nil {
+				err = werr
+			}
+		}
+		return err
+
+	case "prune":
+		fs := newFlags("plan prune", "<plan-file>")
+		dryRun := fs.Bool("dry-run", false, "Report the archives to delete without deleting them")
+		if err := parseArgs(fs, args[1:], 1, 1); err != nil {
+			return err
+		}
+		plan, err := tarsnap.LoadPlan(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		reps, err := plan.PruneContext(ctx, cfg, *dryRun)
+		if err == nil && reps == nil {
+			reps = []tarsnap.SetPruneReport{}
+		}
+		if reps != nil {
+			if werr := writeJSON(w, reps); err == nil {
+				err = werr
+			}
+		}
+		return err
+
+	default:
+		return fmt.Errorf("plan: unknown subcommand %q (want run or prune)", args[0])
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+	"github.com/creachadair/tarsnap/tarsnaptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommands(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("apple\n"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chmod(filepath.Join(src, "a.txt"), 0644); err != nil { // ignore umask
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	for i, name := range []string{"db.1", "db.2", "web.1"} {
+		if err := cfg.Create(name, tarsnap.CreateOptions{
+			Include:      []string{"a.txt"},
+			WorkDir:      src,
+			CreationTime: now.Add(time.Duration(i-10) * time.Hour),
+		}); err != nil {
+			t.Fatalf("Create %q failed: %v", name, err)
+		}
+	}
+
+	// run runs the command and decodes its JSON output into v.
+	run := func(v any, args ...string) {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := runCommand(context.Background(), cfg, args, &buf); err != nil {
+			t.Fatalf("Command %q failed: %v", args, err)
+		}
+		if err := json.Unmarshal(buf.Bytes(), v); err != nil {
+			t.Fatalf("Command %q: invalid output: %v\n%s", args, err, buf.String())
+		}
+	}
+	names := func(archs tarsnap.Archives) []string {
+		out := []string{}
+		for _, a := range archs {
+			out = append(out, a.Name)
+		}
+		return out
+	}
+
+	t.Run("List", func(t *testing.T) {
+		for _, test := range []struct {
+			args []string
+			want []string
+		}{
+			{nil, []string{"db.1", "db.2", "web.1"}},
+			{[]string{"-base", "db"}, []string{"db.1", "db.2"}},
+			{[]string{"-match", "*.1"}, []string{"db.1", "web.1"}},
+			{[]string{"-regexp", `^web`}, []string{"web.1"}},
+			{[]string{"-latest", "1"}, []string{"db.2", "web.1"}},
+			{[]string{"-base", "nonesuch"}, []string{}},
+		} {
+			var got tarsnap.Archives
+			run(&got, append([]string{"list"}, test.args...)...)
+			if diff := cmp.Diff(test.want, names(got)); diff != "" {
+				t.Errorf("list %q (-want, +got):\n%s", test.args, diff)
+			}
+		}
+	})
+
+	t.Run("Entries", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := runCommand(context.Background(), cfg, []string{"entries", "db.1"}, &buf); err != nil {
+			t.Fatalf("entries failed: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("entries: got %d lines, want 1:\n%s", len(lines), buf.String())
+		}
+		var e tarsnap.Entry
+		if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+			t.Fatalf("entries: invalid output: %v", err)
+		}
+		if e.Name != "a.txt" || e.Size != 6 {
+			t.Errorf("entries: got %+v, want a.txt with size 6", e)
+		}
+
+		// The mode is written in a form usable outside Go.
+		var raw map[string]any
+		if err := json.Unmarshal([]byte(lines[0]), &raw); err != nil {
+			t.Fatalf("entries: invalid output: %v", err)
+		}
+		if got := raw["mode"]; got != "-rw-r--r--" {
+			t.Errorf("entries: got mode %v, want -rw-r--r--", got)
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		var d tarsnap.Diff
+		run(&d, "diff", "db.1", "db.2")
+		if d.Old != "db.1" || d.New != "db.2" || len(d.Changes) != 0 {
+			t.Errorf("diff: got %+v, want no changes", d)
+		}
+
+		// Archive a copy of a.txt with other permissions, and check that the
+		// modes are reported as strings.
+		other := t.TempDir()
+		if err := os.WriteFile(filepath.Join(other, "a.txt"), []byte("apple\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Create("other.1", tarsnap.CreateOptions{Include: []string{"a.txt"}, WorkDir: other}); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		var raw struct {
+			Changes []struct {
+				Fields   string
+				Old, New struct{ Mode string }
+			}
+		}
+		run(&raw, "diff", "db.1", "other.1")
+		if len(raw.Changes) != 1 {
+			t.Fatalf("diff: got %+v, want one change", raw)
+		}
+		c := raw.Changes[0]
+		if !strings.Contains(c.Fields, "mode") || c.Old.Mode != "-rw-r--r--" || c.New.Mode != "-rw-------" {
+			t.Errorf("diff: got %+v, want mode changed from -rw-r--r-- to -rw-------", c)
+		}
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		var info tarsnap.SizeInfo
+		run(&info, "size", "db.1")
+		if info.All == nil || info.Archive["db.1"] == nil {
+			t.Errorf("size: got %+v, want all and db.1 sizes", info)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		var rep tarsnap.PruneReport
+		run(&rep, "prune", "-dry-run", "-keep-last", "1")
+		if diff := cmp.Diff([]string{"db.1"}, names(rep.Delete)); diff != "" {
+			t.Errorf("prune (-want, +got):\n%s", diff)
+		}
+		if !rep.DryRun {
+			t.Error("prune: report is not marked as a dry run")
+		}
+
+		policyFile := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(policyFile, []byte(`{"keepLast": 1, "minAge": "10h30m"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		run(&rep, "prune", "-dry-run", "-policy", policyFile)
+		if diff := cmp.Diff([]string{}, names(rep.Delete)); diff != "" { // db.1 is too young
+			t.Errorf("prune -policy (-want, +got):\n%s", diff)
+		}
+
+		// A policy file cannot be combined with individual policy flags.
+		args := []string{"prune", "-dry-run", "-policy", policyFile, "-keep-last", "5"}
+		if err := runCommand(context.Background(), cfg, args, new(bytes.Buffer)); err == nil {
+			t.Errorf("Command %q: got nil, want error", args)
+		}
+	})
+
+	t.Run("Plan", func(t *testing.T) {
+		planFile := filepath.Join(t.TempDir(), "plan.json")
+		if err := os.WriteFile(planFile, []byte(`{"sets": [
+		  {"name": "files", "create": {"include": ["a.txt"], "workDir": `+jsonString(src)+`}}
+		]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var res tarsnap.PlanResult
+		run(&res, "plan", "run", planFile)
+		if len(res.Sets) != 1 || res.Sets[0].Error != "" || !strings.HasPrefix(res.Sets[0].Archive, "files.") {
+			t.Errorf("plan run: got %+v, want one archive of files", res)
+		}
+
+		var reps []tarsnap.SetPruneReport
+		run(&reps, "plan", "prune", "-dry-run", planFile)
+		if len(reps) != 0 {
+			t.Errorf("plan prune: got %+v, want no reports", reps)
+		}
+	})
+
+	for _, bad := range [][]string{
+		{"nonesuch"}, {"list", "extra"}, {"entries"}, {"diff", "db.1"}, {"plan"}, {"plan", "bogus"},
+	} {
+		if err := runCommand(context.Background(), cfg, bad, new(bytes.Buffer)); err == nil {
+			t.Errorf("Command %q: got nil, want error", bad)
+		}
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
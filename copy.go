@@ -0,0 +1,101 @@
+package tarsnap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CopyOptions control the creation of archives from existing archives.
+type CopyOptions struct {
+	// Modify names by these patterns, /old/new/[gps].
+	Modify []string `json:"modify,omitempty"`
+
+	// Exclude files or directories matching these glob patterns.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// If non-zero, set the creation time of the new archive to this time.
+	CreationTime time.Time `json:"creationTime,omitempty" yaml:"creation-time"`
+
+	// Simulate creating archives rather than creating them.
+	DryRun bool `json:"dryRun,omitempty" yaml:"dry-run"`
+}
+
+// Copy creates a new archive dst containing the entries of the existing
+// archive src, filtered and renamed by opts. It is equivalent in effect to
+// "tarsnap -c -f dst opts... @@src".
+//
+// Copying does not re-read or re-upload the data stored in src.
+func (c *Config) Copy(dst, src string, opts CopyOptions) error {
+	return c.CopyContext(context.Background(), dst, src, opts)
+}
+
+// CopyContext is as Copy, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) CopyContext(ctx context.Context, dst, src string, opts CopyOptions) error {
+	return c.MergeContext(ctx, dst, []string{src}, opts)
+}
+
+// Merge creates a new archive dst containing the entries of each of the
+// existing archives srcs in order, filtered and renamed by opts. It is
+// equivalent in effect to "tarsnap -c -f dst opts... @@src1 @@src2 ...".
+func (c *Config) Merge(dst string, srcs []string, opts CopyOptions) error {
+	return c.MergeContext(context.Background(), dst, srcs, opts)
+}
+
+// MergeContext is as Merge, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) MergeContext(ctx context.Context, dst string, srcs []string, opts CopyOptions) error {
+	if len(srcs) == 0 {
+		return errors.New("empty source list")
+	}
+	inputs := make([]string, len(srcs))
+	for i, src := range srcs {
+		if src == "" {
+			return errors.New("empty source archive name")
+		}
+		inputs[i] = "@@" + src
+	}
+	_, err := c.create(ctx, dst, CreateOptions{
+		Modify:       opts.Modify,
+		Exclude:      opts.Exclude,
+		CreationTime: opts.CreationTime,
+		DryRun:       opts.DryRun,
+	}, inputs, nil, false)
+	return err
+}
+
+// Rename renames the archive oldName to newName, preserving its creation time.
+// Tarsnap cannot rename archives directly, so Rename copies the archive to the
+// new name and then deletes the original.
+func (c *Config) Rename(oldName, newName string) error {
+	return c.RenameContext(context.Background(), oldName, newName)
+}
+
+// RenameContext is as Rename, but the tarsnap processes are interrupted if ctx
+// ends before they complete.
+func (c *Config) RenameContext(ctx context.Context, oldName, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	archs, err := c.ListContext(ctx)
+	if err != nil {
+		return err
+	}
+	var created time.Time
+	found := false
+	for _, a := range archs {
+		if a.Name == oldName {
+			created, found = a.Created, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("archive %q: %w", oldName, ErrArchiveNotFound)
+	}
+	if err := c.CopyContext(ctx, newName, oldName, CopyOptions{CreationTime: created}); err != nil {
+		return err
+	}
+	return c.DeleteContext(ctx, oldName)
+}
@@ -0,0 +1,189 @@
+package tarsnap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A ChangeKind classifies a Change between two archives.
+type ChangeKind int
+
+// Kinds of changes between archives.
+const (
+	Added    ChangeKind = iota + 1 // present only in the new archive
+	Removed                        // present only in the old archive
+	Modified                       // present in both, with different metadata
+)
+
+var changeKindNames = map[ChangeKind]string{
+	Added: "added", Removed: "removed", Modified: "modified",
+}
+
+func (k ChangeKind) String() string {
+	if s, ok := changeKindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (k ChangeKind) MarshalText() ([]byte, error) { return []byte(k.String()), nil }
+
+// EntryFields is a set of entry metadata fields that differ between archives.
+type EntryFields int
+
+// Entry metadata fields compared by Diff.
+const (
+	FieldSize    EntryFields = 1 << iota // the size in bytes, or device numbers
+	FieldModTime                         // the modification time
+	FieldMode                            // the file type and permissions
+	FieldOwner                           // the owner or group
+	FieldLink                            // the target of a symbolic or hard link
+)
+
+var entryFieldNames = []struct {
+	field EntryFields
+	name  string
+}{
+	{FieldSize, "size"}, {FieldModTime, "mtime"}, {FieldMode, "mode"}, {FieldOwner, "owner"},
+	{FieldLink, "link"},
+}
+
+func (f EntryFields) String() string {
+	var names []string
+	for _, ef := range entryFieldNames {
+		if f&ef.field != 0 {
+			names = append(names, ef.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (f EntryFields) MarshalText() ([]byte, error) { return []byte(f.String()), nil }
+
+// compareEntries reports which metadata fields differ between a and b.
+func compareEntries(a, b *Entry) EntryFields {
+	var f EntryFields
+	if a.Size != b.Size || a.DevMajor != b.DevMajor || a.DevMinor != b.DevMinor {
+		f |= FieldSize
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		f |= FieldModTime
+	}
+	if a.Mode != b.Mode {
+		f |= FieldMode
+	}
+	if a.Owner != b.Owner || a.Group != b.Group {
+		f |= FieldOwner
+	}
+	if a.LinkTarget != b.LinkTarget || a.HardLinkTo != b.HardLinkTo {
+		f |= FieldLink
+	}
+	return f
+}
+
+// A Change describes a difference in a single entry between two archives.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	Name string     `json:"name"`
+
+	Old *Entry `json:"old,omitempty"` // the old entry; nil if Kind == Added
+	New *Entry `json:"new,omitempty"` // the new entry; nil if Kind == Removed
+
+	// For a modified entry, the fields that differ.
+	Fields EntryFields `json:"fields,omitempty"`
+}
+
+// A Diff reports the differences between the entries of two archives.
+type Diff struct {
+	Old     string   `json:"old"`     // the name of the old archive
+	New     string   `json:"new"`     // the name of the new archive
+	Changes []Change `json:"changes"` // ordered by entry name
+}
+
+// Format writes a text rendering of d to w, in the style of a unified diff.
+// Each added entry is shown with a "+" prefix, each removed entry with a "-"
+// prefix, and each modified entry as a removal of the old and an addition of
+// the new.
+func (d *Diff) Format(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", d.Old, d.New)
+	for _, c := range d.Changes {
+		if c.Old != nil {
+			fmt.Fprintf(bw, "-%v\n", c.Old)
+		}
+		if c.New != nil {
+			fmt.Fprintf(bw, "+%v\n", c.New)
+		}
+	}
+	return bw.Flush()
+}
+
+func (d *Diff) String() string {
+	var sb strings.Builder
+	d.Format(&sb)
+	return sb.String()
+}
+
+// Diff reports the differences between the entries of the old and new
+// archives. Entries are matched by name, and an entry present in both is
+// reported as modified if its size, modification time, mode, owner, group, or
+// link target differ.
+func (c *Config) Diff(oldName, newName string) (*Diff, error) {
+	return c.DiffContext(context.Background(), oldName, newName)
+}
+
+// DiffContext is as Diff, but the tarsnap processes are interrupted if ctx
+// ends before they complete.
+func (c *Config) DiffContext(ctx context.Context, oldName, newName string) (*Diff, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// List both archives concurrently. If either fails, stop the other.
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	names := []string{oldName, newName}
+	entries := make([]map[string]*Entry, len(names))
+	for i, name := range names {
+		m := make(map[string]*Entry)
+		entries[i] = m
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.EntriesContext(ctx, name, func(e *Entry) error {
+				m[e.Name] = e
+				return nil
+			}); err != nil {
+				once.Do(func() { firstErr = err; cancel() })
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	old, cur := entries[0], entries[1]
+	d := &Diff{Old: oldName, New: newName}
+	for name, o := range old {
+		if n, ok := cur[name]; !ok {
+			d.Changes = append(d.Changes, Change{Kind: Removed, Name: name, Old: o})
+		} else if f := compareEntries(o, n); f != 0 {
+			d.Changes = append(d.Changes, Change{Kind: Modified, Name: name, Old: o, New: n, Fields: f})
+		}
+	}
+	for name, n := range cur {
+		if _, ok := old[name]; !ok {
+			d.Changes = append(d.Changes, Change{Kind: Added, Name: name, New: n})
+		}
+	}
+	sort.Slice(d.Changes, func(i, j int) bool { return d.Changes[i].Name < d.Changes[j].Name })
+	return d, nil
+}
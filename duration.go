@@ -0,0 +1,31 @@
+package tarsnap
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Duration is a time.Duration that is encoded as text in the format of
+// time.ParseDuration, such as "36h" or "1500ms", so that durations in plans
+// and policies can be written by hand. The same format is used for JSON,
+// YAML, and command-line flags (Duration implements flag.Value).
+type Duration time.Duration
+
+// String returns d in the format of time.Duration.String.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Set parses s as a duration and stores the result in d.
+func (d *Duration) Set(s string) error { return d.UnmarshalText([]byte(s)) }
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (use a value such as \"36h\")", text)
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,85 @@
+package tarsnap
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Errors reported by tarsnap commands are classified by these sentinel values
+// when the cause can be recognized from the output of the tool. Use errors.Is
+// to check for them, for example:
+//
+//	if errors.Is(err, tarsnap.ErrArchiveNotFound) { ... }
+//
+// Use errors.As with a *CommandError to recover the exit status and the
+// complete error output of the command.
+var (
+	// The specified archive does not exist.
+	ErrArchiveNotFound = errors.New("archive does not exist")
+
+	// An archive with the specified name already exists.
+	ErrArchiveExists = errors.New("archive name already in use")
+
+	// The key file could not be read, or is not a valid key file.
+	ErrKeyFile = errors.New("cannot read key file")
+
+	// The cache directory is out of sync with the server, and must be repaired
+	// by running tarsnap --fsck.
+	ErrCacheOutOfSync = errors.New("cache directory out of sync")
+
+	// Communication with the tarsnap server failed.
+	ErrNetwork = errors.New("network failure")
+
+	// The key file does not contain the keys required for the operation.
+	ErrKeyPermission = errors.New("insufficient key permissions")
+)
+
+// errorKinds maps patterns matching tarsnap error output to the classification
+// errors they indicate. The patterns are checked in order, and the first match
+// wins.
+var errorKinds = []struct {
+	match *regexp.Regexp
+	kind  error
+}{
+	{regexp.MustCompile(`(?i)sequence number mismatch|--fsck`), ErrCacheOutOfSync},
+	{regexp.MustCompile(`(?i)archive.*does not exist|no such archive`), ErrArchiveNotFound},
+	{regexp.MustCompile(`(?i)archive already exists|already exists with the name`), ErrArchiveExists},
+	{regexp.MustCompile(`(?i)keys? (are |is )?(required|needed|missing)|required keys?|not present in key ?file`), ErrKeyPermission},
+	{regexp.MustCompile(`(?i)cannot read key ?file|key ?file is (corrupt|not valid)`), ErrKeyFile},
+	{regexp.MustCompile(`(?i)error (connecting to|looking up)|connection (lost|refused|timed out)|network is unreachable|too many network failures`), ErrNetwork},
+}
+
+// classifyError returns the classification error matching the error output of
+// a tarsnap command, or nil if the cause is not recognized.
+func classifyError(stderr string) error {
+	for _, ek := range errorKinds {
+		if ek.match.MatchString(stderr) {
+			return ek.kind
+		}
+	}
+	return nil
+}
+
+// A CommandError reports the failure of a tarsnap command that ran but exited
+// with a non-zero status.
+type CommandError struct {
+	Args     []string // the command-line arguments
+	ExitCode int      // the exit status of the command
+	Stderr   string   // the complete error output of the command
+
+	// If the cause of the failure was recognized, Kind is one of the sentinel
+	// errors such as ErrArchiveNotFound; otherwise it is nil.
+	Kind error
+}
+
+// Error returns the first line of the error output of the command.
+func (e *CommandError) Error() string {
+	if line := strings.SplitN(strings.TrimSpace(e.Stderr), "\n", 2)[0]; line != "" {
+		return line
+	}
+	return "tarsnap failed with no error output"
+}
+
+// Unwrap returns the classification of e, if any.
+func (e *CommandError) Unwrap() error { return e.Kind }
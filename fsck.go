@@ -0,0 +1,57 @@
+package tarsnap
+
+import "context"
+
+// Fsck rebuilds the cache directory from the archives stored on the server.
+// It is equivalent in effect to "tarsnap --fsck".
+//
+// An operation that fails because the cache directory is out of sync reports
+// an error matching ErrCacheOutOfSync, which Fsck can repair:
+//
+//	err := cfg.Create(name, opts)
+//	if errors.Is(err, tarsnap.ErrCacheOutOfSync) {
+//	   if err := cfg.Fsck(); err != nil {
+//	      return err
+//	   }
+//	   err = cfg.Create(name, opts)
+//	}
+func (c *Config) Fsck() error { return c.FsckContext(context.Background()) }
+
+// FsckContext is as Fsck, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) FsckContext(ctx context.Context) error {
+	return c.run(ctx, []string{"--fsck"})
+}
+
+// FsckPrune is as Fsck, but also removes corrupted archives from the server.
+// It is equivalent in effect to "tarsnap --fsck-prune".
+func (c *Config) FsckPrune() error { return c.FsckPruneContext(context.Background()) }
+
+// FsckPruneContext is as FsckPrune, but the tarsnap process is interrupted if
+// ctx ends before it completes.
+func (c *Config) FsckPruneContext(ctx context.Context) error {
+	return c.run(ctx, []string{"--fsck-prune"})
+}
+
+// Recover recovers a checkpointed archive left by an interrupted Create, and
+// completes any interrupted Delete. It is equivalent in effect to
+// "tarsnap --recover".
+func (c *Config) Recover() error { return c.RecoverContext(context.Background()) }
+
+// RecoverContext is as Recover, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) RecoverContext(ctx context.Context) error {
+	return c.run(ctx, []string{"--recover"})
+}
+
+// InitializeCacheDir creates and initializes an empty cache directory for a
+// new key. It is equivalent in effect to "tarsnap --initialize-cachedir".
+func (c *Config) InitializeCacheDir() error {
+	return c.InitializeCacheDirContext(context.Background())
+}
+
+// InitializeCacheDirContext is as InitializeCacheDir, but the tarsnap process
+// is interrupted if ctx ends before it completes.
+func (c *Config) InitializeCacheDirContext(ctx context.Context) error {
+	return c.run(ctx, []string{"--initialize-cachedir"})
+}
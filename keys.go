@@ -0,0 +1,244 @@
+package tarsnap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyPerm is a set of permissions that may be granted by a tarsnap key file.
+type KeyPerm int
+
+// Permissions that may be granted by a key file.
+const (
+	KeyRead   KeyPerm = 1 << iota // read and list archives
+	KeyWrite                      // create archives
+	KeyDelete                     // delete individual archives
+	KeyNuke                       // delete all archives at once
+
+	KeyAll = KeyRead | KeyWrite | KeyDelete | KeyNuke
+)
+
+var keyPermNames = []struct {
+	perm       KeyPerm
+	name, flag string
+}{
+	{KeyRead, "read", "-r"},
+	{KeyWrite, "write", "-w"},
+	{KeyDelete, "delete", "-d"},
+	{KeyNuke, "nuke", "--nuke"},
+}
+
+func (p KeyPerm) String() string {
+	var names []string
+	for _, kp := range keyPermNames {
+		if p&kp.perm != 0 {
+			names = append(names, kp.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// PassphraseOptions control the passphrase protection of a key file written
+// by the tarsnap key management tools.
+type PassphraseOptions struct {
+	// Protect the new key file with a passphrase (as --passphrased). The tool
+	// prompts for the passphrase on the terminal.
+	Passphrased bool `json:"passphrased,omitempty"`
+
+	// If positive, limit the memory used to derive a key from the passphrase
+	// to this many bytes (as --passphrase-mem).
+	MaxMemory int64 `json:"maxMemory,omitempty" yaml:"max-memory"`
+
+	// If positive, limit the time spent to derive a key from the passphrase
+	// (as --passphrase-time). In JSON and YAML it is written as a string such
+	// as "2s".
+	MaxTime Duration `json:"maxTime,omitempty" yaml:"max-time"`
+}
+
+func (p PassphraseOptions) args() []string {
+	var args []string
+	if p.Passphrased {
+		args = append(args, "--passphrased")
+	}
+	if p.MaxMemory > 0 {
+		args = append(args, "--passphrase-mem", strconv.FormatInt(p.MaxMemory, 10))
+	}
+	if p.MaxTime > 0 {
+		args = append(args, "--passphrase-time", strconv.FormatFloat(time.Duration(p.MaxTime).Seconds(), 'g', -1, 64))
+	}
+	return args
+}
+
+// KeygenOptions control the generation of a new key file.
+type KeygenOptions struct {
+	// Write the new key file to this path. If empty, use the Keyfile from the
+	// config.
+	Keyfile string `json:"keyFile,omitempty"`
+
+	User    string `json:"user"`    // the email address of the tarsnap account
+	Machine string `json:"machine"` // the name of the machine to register
+
+	// The password for the tarsnap account. If set, it is written to the
+	// standard input of the tool, which tarsnap-keygen reads when it is not
+	// attached to a terminal.
+	Password string `json:"-" yaml:"-"`
+
+	PassphraseOptions
+}
+
+// Keygen registers a new machine with the tarsnap service and writes its key
+// file. It is equivalent in effect to "tarsnap-keygen opts...".
+func (c *Config) Keygen(opts KeygenOptions) error {
+	return c.KeygenContext(context.Background(), opts)
+}
+
+// KeygenContext is as Keygen, but the process is interrupted if ctx ends
+// before it completes.
+func (c *Config) KeygenContext(ctx context.Context, opts KeygenOptions) error {
+	keyfile := c.keyfile(opts.Keyfile)
+	if keyfile == "" {
+		return errors.New("empty key file")
+	} else if opts.User == "" {
+		return errors.New("empty user")
+	} else if opts.Machine == "" {
+		return errors.New("empty machine name")
+	}
+	args := []string{"--keyfile", keyfile, "--user", opts.User, "--machine", opts.Machine}
+	var stdin io.Reader
+	if opts.Password != "" {
+		stdin = strings.NewReader(opts.Password + "\n")
+	}
+	return c.execTool(ctx, c.tool("keygen"), append(args, opts.PassphraseOptions.args()...), stdin, nil, nil)
+}
+
+// KeymgmtOptions control the derivation of a key file with restricted
+// permissions from one or more existing key files.
+type KeymgmtOptions struct {
+	// Write the new key file to this path (required).
+	Output string `json:"output"`
+
+	// Grant these permissions in the new key file (required).
+	Perms KeyPerm `json:"perms"`
+
+	// Derive the new key from these key files. If empty, use the Keyfile from
+	// the config.
+	Input []string `json:"input,omitempty"`
+
+	PassphraseOptions
+}
+
+// Keymgmt writes a new key file containing a subset of the keys in one or
+// more existing key files. It is equivalent in effect to "tarsnap-keymgmt
+// opts... input...".
+//
+// For example, to derive a key that can create archives, but not read or
+// delete them:
+//
+//	err := cfg.Keymgmt(tarsnap.KeymgmtOptions{Output: "write.key", Perms: tarsnap.KeyWrite})
+func (c *Config) Keymgmt(opts KeymgmtOptions) error {
+	return c.KeymgmtContext(context.Background(), opts)
+}
+
+// KeymgmtContext is as Keymgmt, but the process is interrupted if ctx ends
+// before it completes.
+func (c *Config) KeymgmtContext(ctx context.Context, opts KeymgmtOptions) error {
+	input := opts.Input
+	if len(input) == 0 {
+		if kf := c.keyfile(""); kf != "" {
+			input = []string{kf}
+		}
+	}
+	if opts.Output == "" {
+		return errors.New("empty output key file")
+	} else if opts.Perms&KeyAll == 0 {
+		return errors.New("no key permissions specified")
+	} else if len(input) == 0 {
+		return errors.New("no input key files")
+	}
+	args := []string{"--outkeyfile", opts.Output}
+	for _, kp := range keyPermNames {
+		if opts.Perms&kp.perm != 0 {
+			args = append(args, kp.flag)
+		}
+	}
+	args = append(args, opts.PassphraseOptions.args()...)
+	return c.execTool(ctx, c.tool("keymgmt"), append(args, input...), nil, nil, nil)
+}
+
+// RecryptOptions control the re-encryption of archives from one key to
+// another.
+type RecryptOptions struct {
+	OldKeyfile  string `json:"oldKeyFile"`  // the key file for the existing archives
+	OldCacheDir string `json:"oldCacheDir"` // the cache directory for the old key
+	NewKeyfile  string `json:"newKeyFile"`  // the key file for the re-encrypted archives
+	NewCacheDir string `json:"newCacheDir"` // the cache directory for the new key
+}
+
+// Recrypt downloads all the archives stored with one key and re-uploads them
+// encrypted with another. It is equivalent in effect to "tarsnap-recrypt
+// opts...".
+func (c *Config) Recrypt(opts RecryptOptions) error {
+	return c.RecryptContext(context.Background(), opts)
+}
+
+// RecryptContext is as Recrypt, but the process is interrupted if ctx ends
+// before it completes.
+func (c *Config) RecryptContext(ctx context.Context, opts RecryptOptions) error {
+	if opts.OldKeyfile == "" || opts.NewKeyfile == "" {
+		return errors.New("empty key file")
+	} else if opts.OldCacheDir == "" || opts.NewCacheDir == "" {
+		return errors.New("empty cache directory")
+	}
+	return c.execTool(ctx, c.tool("recrypt"), []string{
+		"--oldkey", opts.OldKeyfile, "--oldcachedir", opts.OldCacheDir,
+		"--newkey", opts.NewKeyfile, "--newcachedir", opts.NewCacheDir,
+	}, nil, nil, nil)
+}
+
+// KeyPasswdOptions control changes to the passphrase protecting a key file.
+type KeyPasswdOptions struct {
+	// Read the existing key from this file. If empty, use the Keyfile from
+	// the config.
+	Keyfile string `json:"keyFile,omitempty"`
+
+	// Write the updated key file to this path (required).
+	Output string `json:"output"`
+
+	PassphraseOptions
+}
+
+// KeyPasswd writes a copy of a key file with a new passphrase, or with the
+// passphrase removed if opts.Passphrased is false. It is equivalent in effect
+// to "tarsnap-key-passwd opts...".  The tool prompts for the passphrases on
+// the terminal.
+func (c *Config) KeyPasswd(opts KeyPasswdOptions) error {
+	return c.KeyPasswdContext(context.Background(), opts)
+}
+
+// KeyPasswdContext is as KeyPasswd, but the process is interrupted if ctx ends
+// before it completes.
+func (c *Config) KeyPasswdContext(ctx context.Context, opts KeyPasswdOptions) error {
+	keyfile := c.keyfile(opts.Keyfile)
+	if keyfile == "" {
+		return errors.New("empty key file")
+	} else if opts.Output == "" {
+		return errors.New("empty output key file")
+	}
+	args := []string{"--keyfile", keyfile, "--outkeyfile", opts.Output}
+	return c.execTool(ctx, c.tool("key-passwd"), append(args, opts.PassphraseOptions.args()...), nil, nil, nil)
+}
+
+// keyfile returns path if it is non-empty, otherwise the Keyfile from c.
+func (c *Config) keyfile(path string) string {
+	if path == "" && c != nil {
+		return c.Keyfile
+	}
+	return path
+}
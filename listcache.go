@@ -0,0 +1,64 @@
+package tarsnap
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// listCache is the format of the file stored by a ListCache.
+type listCache struct {
+	Tag      string   `json:"tag"`
+	Archives Archives `json:"archives"`
+}
+
+// cachedList returns the archives stored in c.ListCache if its tag matches the
+// current cache tag, and otherwise lists the archives and updates the cache.
+// Errors reading or writing the cache are not reported to the caller, since
+// the list is still available from tarsnap.
+func (c *Config) cachedList(ctx context.Context) (Archives, error) {
+	tag, err := c.CacheTag()
+	if err != nil || tag == "" {
+		return c.listArchives(ctx)
+	}
+	if data, err := os.ReadFile(c.ListCache); err == nil {
+		var lc listCache
+		if json.Unmarshal(data, &lc) == nil && lc.Tag == tag {
+			return lc.Archives, nil
+		}
+	}
+
+	archs, err := c.listArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeListCache(c.ListCache, listCache{Tag: tag, Archives: archs}); err != nil {
+		log.Printf("WARNING: Updating list cache: %v", err)
+	}
+	return archs, nil
+}
+
+// writeListCache atomically replaces the contents of path with lc.
+func writeListCache(path string, lc listCache) error {
+	data, err := json.Marshal(lc)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
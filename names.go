@@ -0,0 +1,104 @@
+package tarsnap
+
+import "strings"
+
+// Listings produced by tarsnap escape bytes in entry names that are not
+// printable. A backslash is written as "\\", the control characters BEL, BS,
+// FF, NL, CR, HT, and VT are written as C-style escapes ("\a", "\b", ...), and
+// any other non-printable byte is written as a backslash and three octal
+// digits, as "\033".
+
+// The C-style escape letters, and the bytes they denote, in correspondence.
+const (
+	escapeLetters = `abfnrtv\`
+	escapeBytes   = "\a\b\f\n\r\t\v\\"
+)
+
+// unescapeName decodes the escape sequences in a name from a tarsnap listing.
+// Malformed escapes are copied through unchanged.
+func unescapeName(s string) string {
+	i := strings.IndexByte(s, '\\')
+	if i < 0 {
+		return s // fast path: nothing to decode
+	}
+	var sb strings.Builder
+	sb.WriteString(s[:i])
+	for i < len(s) {
+		ch := s[i]
+		if ch != '\\' || i+1 == len(s) {
+			sb.WriteByte(ch)
+			i++
+			continue
+		}
+		if j := strings.IndexByte(escapeLetters, s[i+1]); j >= 0 {
+			sb.WriteByte(escapeBytes[j])
+			i += 2
+		} else if v, ok := parseOctal(s[i+1:]); ok {
+			sb.WriteByte(v)
+			i += 4
+		} else {
+			sb.WriteByte(ch)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// parseOctal parses a byte value from three octal digits at the start of s.
+func parseOctal(s string) (byte, bool) {
+	if len(s) < 3 {
+		return 0, false
+	}
+	var v int
+	for _, ch := range []byte(s[:3]) {
+		if ch < '0' || ch > '7' {
+			return 0, false
+		}
+		v = 8*v + int(ch-'0')
+	}
+	if v > 0xff {
+		return 0, false
+	}
+	return byte(v), true
+}
+
+// EscapeName encodes name in the form tarsnap uses for entry names in
+// listings. It is the inverse of the decoding applied to the names reported
+// by Entries, and may be used to compare names against raw tarsnap output.
+// As in tarsnap's default locale, every byte outside printable ASCII is
+// escaped.
+func EscapeName(name string) string {
+	var sb strings.Builder
+	for _, ch := range []byte(name) {
+		if j := strings.IndexByte(escapeBytes, ch); j >= 0 {
+			sb.WriteByte('\\')
+			sb.WriteByte(escapeLetters[j])
+		} else if ch >= ' ' && ch <= '~' {
+			sb.WriteByte(ch)
+		} else {
+			sb.WriteByte('\\')
+			sb.WriteByte('0' + ch>>6)
+			sb.WriteByte('0' + ch>>3&7)
+			sb.WriteByte('0' + ch&7)
+		}
+	}
+	return sb.String()
+}
+
+// LiteralPattern returns a pattern that matches exactly the entry name, by
+// escaping the characters that tarsnap treats as wildcards. The result may be
+// used in the Include and Exclude lists of ExtractOptions, or the Exclude list
+// of CreateOptions, to select a file whose name contains "*", "?", "[", or "\".
+func LiteralPattern(name string) string {
+	if !strings.ContainsAny(name, `*?[\`) {
+		return name
+	}
+	var sb strings.Builder
+	for _, ch := range []byte(name) {
+		if strings.IndexByte(`*?[\`, ch) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String()
+}
@@ -0,0 +1,314 @@
+package tarsnap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NameFields are the structured fields encoded in an archive name by a
+// NamingScheme.
+type NameFields struct {
+	Host string    `json:"host,omitempty"` // the host the archive was made on
+	Set  string    `json:"set,omitempty"`  // the backup set, e.g., "db" or "home"
+	Kind string    `json:"kind,omitempty"` // the kind of archive, e.g., "hourly"
+	Time time.Time `json:"time,omitempty"` // the time the archive was made, in UTC
+}
+
+// A NamingScheme generates archive names from structured fields, and parses
+// archive names back into those fields.
+type NamingScheme interface {
+	// Format returns an archive name for the specified fields, or an error if
+	// the fields cannot be represented by the scheme.
+	Format(NameFields) (string, error)
+
+	// Parse parses an archive name. It reports false if the name was not
+	// generated by the scheme.
+	Parse(name string) (NameFields, bool)
+}
+
+// DefaultTimeLayout is the time layout used by a {time} placeholder in a
+// Template that does not specify one.
+const DefaultTimeLayout = "20060102T150405"
+
+// A Template is a NamingScheme defined by a template string. The template is
+// literal text with placeholders for the fields of a name:
+//
+//	{host}  -- the Host field
+//	{set}   -- the Set field
+//	{kind}  -- the Kind field
+//	{time}  -- the Time field, formatted as DefaultTimeLayout
+//	{time:layout} -- the Time field, formatted by a time.Format layout
+//
+// For example, "{host}/{set}.{time:2006-01-02T1504}" produces names like
+// "venice/db.2024-05-01T0300".
+//
+// The host, set, and kind may not be empty or contain "/". Times are formatted
+// in UTC, and the layout must produce fixed-width values, so that names can be
+// parsed unambiguously.
+//
+// Placeholders for the host, set, and kind must be separated by literal text,
+// and a value may not contain the separator that follows its placeholder: with
+// "{host}-{set}.{time}" the host "web-01" cannot be told apart from the set, so
+// Format reports an error for it. Since no value may contain "/", it is always
+// a safe separator.
+type Template struct {
+	text   string
+	parts  []tmplPart
+	re     *regexp.Regexp
+	layout string // the layout of the {time} placeholder, if any
+}
+
+// A tmplPart is a literal string or a placeholder of a Template.
+type tmplPart struct {
+	lit   string
+	field string // if non-empty, a placeholder for this field
+}
+
+// ParseTemplate parses a Template from a template string. Each field may
+// occur at most once in the template. ParseTemplate reports an error if the
+// template cannot produce names that parse back to the values they were
+// generated from.
+func ParseTemplate(s string) (*Template, error) {
+	if s == "" {
+		return nil, errors.New("template: empty template")
+	}
+	t := &Template{text: s}
+	var re strings.Builder
+	re.WriteString("^")
+	seen := make(map[string]bool)
+	for rest := s; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			i = len(rest)
+		}
+		if i > 0 {
+			t.parts = append(t.parts, tmplPart{lit: rest[:i]})
+			re.WriteString(regexp.QuoteMeta(rest[:i]))
+			rest = rest[i:]
+			continue
+		}
+		j := strings.IndexByte(rest, '}')
+		if j < 0 {
+			return nil, errors.New("template: unterminated placeholder")
+		}
+		field, layout, hasLayout := strings.Cut(rest[1:j], ":")
+		rest = rest[j+1:]
+		if seen[field] {
+			return nil, fmt.Errorf("template: duplicate placeholder {%s}", field)
+		}
+		seen[field] = true
+
+		switch field {
+		case "host", "set", "kind":
+			if hasLayout {
+				return nil, fmt.Errorf("template: unexpected layout for {%s}", field)
+			}
+			if n := len(t.parts); n != 0 && t.parts[n-1].field != "" && t.parts[n-1].field != "time" {
+				return nil, fmt.Errorf("template: placeholders {%s} and {%s} must be separated by literal text",
+					t.parts[n-1].field, field)
+			}
+			re.WriteString(`([^/]+?)`)
+		case "time":
+			if !hasLayout {
+				layout = DefaultTimeLayout
+			} else if layout == "" {
+				return nil, errors.New("template: empty time layout")
+			}
+			t.layout = layout
+			re.WriteString("(" + layoutPattern(layout) + ")")
+		default:
+			return nil, fmt.Errorf("template: unknown placeholder {%s}", field)
+		}
+		t.parts = append(t.parts, tmplPart{field: field})
+	}
+	re.WriteString("$")
+	t.re = regexp.MustCompile(re.String())
+
+	// Check that a sample name round-trips, to catch layouts that do not
+	// produce fixed-width values.
+	if _, err := t.Format(sampleFields); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	return t, nil
+}
+
+// sampleFields are the values ParseTemplate uses to check a template. The time
+// has two-digit values in every field, so that a layout with variable-width
+// fields such as "1/2" does not match the fixed-width pattern for it.
+var sampleFields = NameFields{
+	Host: "host",
+	Set:  "set",
+	Kind: "kind",
+	Time: time.Date(2006, 11, 22, 13, 14, 15, 0, time.UTC),
+}
+
+// MustParseTemplate is as ParseTemplate, but panics if s is invalid.
+func MustParseTemplate(s string) *Template {
+	t, err := ParseTemplate(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// layoutPattern returns a regular expression matching the output of a
+// fixed-width time layout: each digit matches a digit, each letter a letter,
+// and other characters themselves.
+func layoutPattern(layout string) string {
+	var sb strings.Builder
+	for _, ch := range layout {
+		switch {
+		case ch >= '0' && ch <= '9':
+			sb.WriteString(`\d`)
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+			sb.WriteString(`[A-Za-z]`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
+
+// hasField reports whether t has a placeholder for the named field.
+func (t *Template) hasField(field string) bool {
+	for _, p := range t.parts {
+		if p.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the template string of t.
+func (t *Template) String() string { return t.text }
+
+// Format implements the NamingScheme interface. Fields not used by the
+// template are ignored.
+func (t *Template) Format(f NameFields) (string, error) {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		switch p.field {
+		case "":
+			sb.WriteString(p.lit)
+		case "time":
+			if f.Time.IsZero() {
+				return "", errors.New("missing time")
+			}
+			sb.WriteString(f.Time.UTC().Format(t.layout))
+		default:
+			v := f.get(p.field)
+			if v == "" {
+				return "", fmt.Errorf("missing %s", p.field)
+			} else if strings.Contains(v, "/") {
+				return "", fmt.Errorf("invalid %s %q: contains %q", p.field, v, "/")
+			}
+			sb.WriteString(v)
+		}
+	}
+
+	// Check that the name parses back to the same fields, so that names
+	// generated by t are always recognized by it.
+	name := sb.String()
+	g, ok := t.Parse(name)
+	for _, p := range t.parts {
+		if !ok || p.field == "" {
+			continue
+		} else if p.field == "time" {
+			ok = g.Time.Format(t.layout) == f.Time.UTC().Format(t.layout)
+		} else {
+			ok = g.get(p.field) == f.get(p.field)
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("name %q is ambiguous for template %q", name, t.text)
+	}
+	return name, nil
+}
+
+// Parse implements the NamingScheme interface.
+func (t *Template) Parse(name string) (NameFields, bool) {
+	m := t.re.FindStringSubmatch(name)
+	if m == nil {
+		return NameFields{}, false
+	}
+	var f NameFields
+	i := 1
+	for _, p := range t.parts {
+		switch p.field {
+		case "":
+			continue
+		case "time":
+			ts, err := time.ParseInLocation(t.layout, m[i], time.UTC)
+			if err != nil {
+				return NameFields{}, false
+			}
+			f.Time = ts
+		case "host":
+			f.Host = m[i]
+		case "set":
+			f.Set = m[i]
+		case "kind":
+			f.Kind = m[i]
+		}
+		i++
+	}
+	return f, true
+}
+
+func (f NameFields) get(field string) string {
+	switch field {
+	case "host":
+		return f.Host
+	case "set":
+		return f.Set
+	case "kind":
+		return f.Kind
+	}
+	return ""
+}
+
+// CreateNamed creates an archive named by the naming scheme of c from fields,
+// and returns the name of the archive. If fields.Time is zero, it is set to
+// opts.CreationTime if that is set, or otherwise the current time; if the
+// Time is set and opts.CreationTime is zero, the archive's creation time is
+// set to match its name. If fields.Host is empty, it is set to the name of
+// the local host.
+//
+// CreateNamed reports an error if c has no naming scheme.
+func (c *Config) CreateNamed(fields NameFields, opts CreateOptions) (string, error) {
+	return c.CreateNamedContext(context.Background(), fields, opts)
+}
+
+// CreateNamedContext is as CreateNamed, but the tarsnap process is interrupted
+// if ctx ends before it completes.
+func (c *Config) CreateNamedContext(ctx context.Context, fields NameFields, opts CreateOptions) (string, error) {
+	if c == nil || c.Naming == nil {
+		return "", errors.New("no naming scheme")
+	}
+	if fields.Time.IsZero() {
+		if opts.CreationTime.IsZero() {
+			fields.Time = time.Now()
+		} else {
+			fields.Time = opts.CreationTime
+		}
+	} else if opts.CreationTime.IsZero() {
+		opts.CreationTime = fields.Time
+	}
+	if fields.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("getting host name: %w", err)
+		}
+		fields.Host = host
+	}
+	name, err := c.Naming.Format(fields)
+	if err != nil {
+		return "", err
+	}
+	return name, c.CreateContext(ctx, name, opts)
+}
@@ -0,0 +1,79 @@
+package tarsnap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MinRateLimit is the smallest bandwidth limit accepted by tarsnap, in bytes
+// per second.
+const MinRateLimit = 8000
+
+// RateLimits control the network bandwidth used by tarsnap, in bytes per
+// second. A zero limit means no limit is imposed. Each non-zero limit must be
+// at least MinRateLimit.
+type RateLimits struct {
+	// Limit both uploads and downloads to this rate (as --maxbw-rate).
+	Rate int64 `json:"rate,omitempty"`
+
+	// Limit uploads to this rate (as --maxbw-rate-up).
+	Up int64 `json:"up,omitempty"`
+
+	// Limit downloads to this rate (as --maxbw-rate-down).
+	Down int64 `json:"down,omitempty"`
+}
+
+func (r RateLimits) validate() error {
+	for _, lim := range []struct {
+		flag string
+		rate int64
+	}{
+		{"rate", r.Rate}, {"upload rate", r.Up}, {"download rate", r.Down},
+	} {
+		if lim.rate != 0 && lim.rate < MinRateLimit {
+			return fmt.Errorf("%s limit %d is less than %d bytes/sec", lim.flag, lim.rate, MinRateLimit)
+		}
+	}
+	return nil
+}
+
+func (r RateLimits) args() []string {
+	var args []string
+	if r.Rate > 0 {
+		args = append(args, "--maxbw-rate", strconv.FormatInt(r.Rate, 10))
+	}
+	if r.Up > 0 {
+		args = append(args, "--maxbw-rate-up", strconv.FormatInt(r.Up, 10))
+	}
+	if r.Down > 0 {
+		args = append(args, "--maxbw-rate-down", strconv.FormatInt(r.Down, 10))
+	}
+	return args
+}
+
+// networkArgs validates the network settings of opts and returns the tarsnap
+// flags to apply them.
+func (opts *CreateOptions) networkArgs() ([]string, error) {
+	if err := opts.RateLimit.validate(); err != nil {
+		return nil, err
+	} else if opts.MaxUploadBytes < 0 {
+		return nil, errors.New("negative upload limit")
+	} else if opts.DiskPause < 0 {
+		return nil, errors.New("negative disk pause")
+	}
+	args := opts.RateLimit.args()
+	if opts.MaxUploadBytes > 0 {
+		args = append(args, "--maxbw", strconv.FormatInt(opts.MaxUploadBytes, 10))
+	}
+	if opts.AggressiveNetworking {
+		args = append(args, "--aggressive-networking")
+	}
+	if opts.DiskPause > 0 {
+		// Tarsnap expects milliseconds; round up so a short pause is not lost.
+		ms := (time.Duration(opts.DiskPause) + time.Millisecond - 1) / time.Millisecond
+		args = append(args, "--disk-pause", strconv.FormatInt(int64(ms), 10))
+	}
+	return args, nil
+}
@@ -0,0 +1,256 @@
+package tarsnap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Plan is a declarative description of a collection of backup sets. A plan
+// is typically loaded from a JSON file with LoadPlan, for example:
+//
+//	{"sets": [{
+//	   "name": "home",
+//	   "archive": "{host}/{set}.{time}",
+//	   "create": {"include": ["Documents", "Pictures"], "workDir": "/home/me"},
+//	   "schedule": "daily",
+//	   "retain": {"daily": 7, "weekly": 4, "monthly": 12, "minAge": "36h"}
+//	}]}
+type Plan struct {
+	Sets []*BackupSet `json:"sets" yaml:"sets"`
+}
+
+// A BackupSet describes a set of files to be archived together.
+type BackupSet struct {
+	// The name of the set, which must be unique within its plan. It is the
+	// value of the {set} placeholder in the archive name template.
+	Name string `json:"name" yaml:"name"`
+
+	// The kind of the set, the value of the {kind} placeholder in the archive
+	// name template, e.g., "hourly". This may be empty if the template does
+	// not use it.
+	Kind string `json:"kind,omitempty" yaml:"kind"`
+
+	// A template for the names of archives (see Template), which must include
+	// {set} and {time} placeholders so that the names of archives are unique.
+	// If empty, the template is DefaultSetTemplate.
+	Archive string `json:"archive,omitempty" yaml:"archive"`
+
+	// The options for creating archives of the set. The Include list must be
+	// non-empty.
+	Create CreateOptions `json:"create" yaml:"create"`
+
+	// A hint for how often the set should be archived, e.g., "daily" or a
+	// crontab schedule. The package does not interpret this value; it is for
+	// use by the scheduler that runs the plan.
+	Schedule string `json:"schedule,omitempty" yaml:"schedule"`
+
+	// If not nil, the retention policy for archives of the set. The policy is
+	// applied separately to the archives of each host, and its Overrides are
+	// ignored. Archives of sets without a policy are not pruned.
+	Retain *Policy `json:"retain,omitempty" yaml:"retain"`
+}
+
+// DefaultSetTemplate is the archive name template used for a BackupSet that
+// does not specify one.
+const DefaultSetTemplate = "{set}.{time}"
+
+// template returns the parsed archive name template of s.
+func (s *BackupSet) template() (*Template, error) {
+	if s.Archive == "" {
+		return ParseTemplate(DefaultSetTemplate)
+	}
+	return ParseTemplate(s.Archive)
+}
+
+// LoadPlan reads and parses a JSON plan from the specified file.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePlan(data)
+	if err != nil {
+		return nil, fmt.Errorf("plan %q: %w", path, err)
+	}
+	return p, nil
+}
+
+// ParsePlan parses and validates a JSON plan. Unknown fields are reported as
+// errors, to catch misspelled settings.
+func ParsePlan(data []byte) (*Plan, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var p Plan
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate reports an error if p is not a valid plan.
+func (p *Plan) Validate() error {
+	seen := make(map[string]bool)
+	for i, s := range p.Sets {
+		switch {
+		case s == nil:
+			return fmt.Errorf("set %d is empty", i+1)
+		case s.Name == "":
+			return fmt.Errorf("set %d has no name", i+1)
+		case seen[s.Name]:
+			return fmt.Errorf("duplicate set name %q", s.Name)
+		case len(s.Create.Include) == 0:
+			return fmt.Errorf("set %q: empty include list", s.Name)
+		}
+		seen[s.Name] = true
+		tmpl, err := s.template()
+		if err != nil {
+			return fmt.Errorf("set %q: %w", s.Name, err)
+		}
+		for _, field := range []string{"set", "time"} {
+			if !tmpl.hasField(field) {
+				return fmt.Errorf("set %q: archive template %q has no {%s}", s.Name, tmpl, field)
+			}
+		}
+	}
+	return nil
+}
+
+// A SetResult reports the outcome of archiving a single BackupSet.
+type SetResult struct {
+	Set     string `json:"set"`
+	Archive string `json:"archive,omitempty"` // the name of the archive, if known
+
+	Err   error  `json:"-"`
+	Error string `json:"error,omitempty"` // the text of Err, if not nil
+}
+
+// A PlanResult reports the outcome of running a Plan.
+type PlanResult struct {
+	Time time.Time   `json:"time"` // the time recorded for the archives, in UTC
+	Sets []SetResult `json:"sets"` // in the order of the plan
+}
+
+// Run creates an archive for each set of p in order, using c to run tarsnap.
+// Every archive is named and timestamped with the same time, the start of the
+// run. A failure in one set does not prevent the creation of the others.
+//
+// Run returns the results of all the sets, along with an error combining the
+// errors of the sets that failed, or nil if all succeeded.
+func (p *Plan) Run(c *Config) (*PlanResult, error) {
+	return p.RunContext(context.Background(), c)
+}
+
+// RunContext is as Run, but the tarsnap processes are interrupted if ctx ends
+// before they complete. The sets that were not started when ctx ends report
+// its error.
+func (p *Plan) RunContext(ctx context.Context, c *Config) (*PlanResult, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("getting host name: %w", err)
+	}
+	res := &PlanResult{Time: time.Now().UTC().Truncate(time.Second)}
+
+	var errs []error
+	for _, s := range p.Sets {
+		sr := SetResult{Set: s.Name}
+		if err := ctx.Err(); err != nil {
+			sr.Err = err
+		} else {
+			sr.Archive, sr.Err = p.runSet(ctx, c, s, NameFields{
+				Host: host, Set: s.Name, Kind: s.Kind, Time: res.Time,
+			})
+		}
+		if sr.Err != nil {
+			sr.Error = sr.Err.Error()
+			errs = append(errs, fmt.Errorf("set %q: %w", s.Name, sr.Err))
+		}
+		res.Sets = append(res.Sets, sr)
+	}
+	return res, errors.Join(errs...)
+}
+
+// runSet creates an archive for s, and returns its name.
+func (p *Plan) runSet(ctx context.Context, c *Config, s *BackupSet, fields NameFields) (string, error) {
+	tmpl, err := s.template()
+	if err != nil {
+		return "", err
+	}
+	var sc Config
+	if c != nil {
+		sc = *c
+	}
+	sc.Naming = tmpl
+	return sc.CreateNamedContext(ctx, fields, s.Create)
+}
+
+// A SetPruneReport reports the effect of pruning the archives of a BackupSet.
+type SetPruneReport struct {
+	Set string `json:"set"`
+	*PruneReport
+}
+
+// Prune applies the retention policy of each set of p to its archives, and
+// deletes the archives not retained. The archives of a set are those whose
+// names match its template with the name of the set. Sets without a policy
+// are skipped. If dryRun is true, Prune reports the archives it would delete
+// without deleting them.
+//
+// If deleting fails, Prune returns the reports along with the error, and some
+// of the archives reported for deletion may not have been deleted.
+func (p *Plan) Prune(c *Config, dryRun bool) ([]SetPruneReport, error) {
+	return p.PruneContext(context.Background(), c, dryRun)
+}
+
+// PruneContext is as Prune, but the tarsnap processes are interrupted if ctx
+// ends before they complete.
+func (p *Plan) PruneContext(ctx context.Context, c *Config, dryRun bool) ([]SetPruneReport, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	archs, err := c.ListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	var reps []SetPruneReport
+	var drop []string
+	for _, s := range p.Sets {
+		if s.Retain == nil {
+			continue
+		}
+		tmpl, _ := s.template()          // already validated
+		hosts := make(map[string]string) // archive name → host
+		mine := archs.Filter(func(a Archive) bool {
+			f, ok := tmpl.Parse(strings.TrimSuffix(a.Name, partialSuffix))
+			hosts[a.Name] = f.Host
+			return ok && f.Set == s.Name
+		})
+		policy := *s.Retain
+		policy.Overrides = nil
+		keep, del := policy.applyBy(mine, now, func(a Archive) string { return hosts[a.Name] })
+		reps = append(reps, SetPruneReport{
+			Set:         s.Name,
+			PruneReport: &PruneReport{Keep: keep, Delete: del, DryRun: dryRun},
+		})
+		for _, a := range del {
+			drop = append(drop, a.Name)
+		}
+	}
+	if dryRun || len(drop) == 0 {
+		return reps, nil
+	}
+	return reps, c.DeleteContext(ctx, drop...)
+}
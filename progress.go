@@ -0,0 +1,112 @@
+package tarsnap
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultProgressBytes is the default interval, in bytes, between progress
+// reports for a Create or Extract with a progress callback.
+const DefaultProgressBytes = 1 << 20
+
+// Progress reports the status of a running Create or Extract operation.
+type Progress struct {
+	Bytes   int64         // total bytes processed so far
+	Files   int64         // total files processed so far
+	Path    string        // the path of the file most recently processed
+	Elapsed time.Duration // time elapsed since the operation began
+}
+
+// progressArgs returns the tarsnap flags needed to report progress at
+// intervals of n bytes, or DefaultProgressBytes if n <= 0.
+func progressArgs(n int64) []string {
+	if n <= 0 {
+		n = DefaultProgressBytes
+	}
+	return []string{"-v", "--progress-bytes", strconv.FormatInt(n, 10), "--no-humanize-numbers"}
+}
+
+// Progress messages from tarsnap --progress-bytes.
+var progressLine = regexp.MustCompile(`(?i)^\s*processed\s+([\d,]+)\s+files?,\s+([\d,]+)(\s+bytes)?`)
+
+// progressTracker consumes lines of tarsnap output describing the progress of
+// an operation, and reports them to a callback.
+type progressTracker struct {
+	start time.Time
+	op    string // the verbose prefix for each file, e.g., "a" for create
+	cur   Progress
+	f     func(Progress)
+}
+
+func newProgressTracker(op string, f func(Progress)) *progressTracker {
+	return &progressTracker{start: time.Now(), op: op + " ", f: f}
+}
+
+// line processes a single line of error output, and reports whether it was a
+// progress update.
+func (p *progressTracker) line(s string) bool {
+	if path, ok := strings.CutPrefix(s, p.op); ok {
+		p.cur.Path = path
+		p.cur.Files++
+	} else if m := progressLine.FindStringSubmatch(s); m != nil {
+		p.cur.Files = parseCount(m[1])
+		p.cur.Bytes = parseCount(m[2])
+	} else {
+		return false
+	}
+	p.cur.Elapsed = time.Since(p.start)
+	p.f(p.cur)
+	return true
+}
+
+func parseCount(s string) int64 {
+	v, _ := strconv.ParseInt(strings.ReplaceAll(s, ",", ""), 10, 64)
+	return v
+}
+
+// lineWriter is an io.Writer that calls a function for each complete line of
+// its input. Lines for which the function reports false are copied to rest.
+type lineWriter struct {
+	f    func(string) bool
+	rest io.Writer
+	buf  []byte
+}
+
+// Write implements the io.Writer interface.
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := w.buf[:i+1]
+		w.buf = w.buf[i+1:]
+		if err := w.emit(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// flush processes any incomplete line remaining in the buffer.
+func (w *lineWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := w.buf
+	w.buf = nil
+	return w.emit(line)
+}
+
+func (w *lineWriter) emit(line []byte) error {
+	if text := strings.TrimRight(string(line), "\r\n"); text == "" || w.f(text) {
+		return nil
+	}
+	_, err := w.rest.Write(line)
+	return err
+}
@@ -0,0 +1,130 @@
+package tarsnap
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// The query methods of Archives require the slice to be sorted, as returned
+// by List, and use binary search over that order where possible. Methods that
+// return a subrange of the slice share storage with it.
+
+// searchTime returns the index of the first archive in a created at or after
+// t, or if after is true, strictly after t.
+func (a Archives) searchTime(t time.Time, after bool) int {
+	return sort.Search(len(a), func(i int) bool {
+		if after {
+			return a[i].Created.After(t)
+		}
+		return !a[i].Created.Before(t)
+	})
+}
+
+// Before returns the archives created strictly before t.
+func (a Archives) Before(t time.Time) Archives { return a[:a.searchTime(t, false)] }
+
+// After returns the archives created strictly after t.
+func (a Archives) After(t time.Time) Archives { return a[a.searchTime(t, true):] }
+
+// Between returns the archives created at or after start and before end.
+func (a Archives) Between(start, end time.Time) Archives {
+	lo, hi := a.searchTime(start, false), a.searchTime(end, false)
+	if hi < lo {
+		return nil
+	}
+	return a[lo:hi]
+}
+
+// Bases returns the distinct bases of the archives, in lexicographic order.
+func (a Archives) Bases() []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, arch := range a {
+		if !seen[arch.Base] {
+			seen[arch.Base] = true
+			out = append(out, arch.Base)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// GroupByBase partitions the archives by base. Each group is in the same
+// relative order as a.
+func (a Archives) GroupByBase() map[string]Archives {
+	out := make(map[string]Archives)
+	for _, arch := range a {
+		out[arch.Base] = append(out[arch.Base], arch)
+	}
+	return out
+}
+
+// LatestN returns the n most recently-created complete archives with the given
+// base, in order of creation. It returns fewer than n if there are not enough.
+func (a Archives) LatestN(base string, n int) Archives {
+	var out Archives
+	for i := len(a) - 1; i >= 0 && len(out) < n; i-- {
+		if a[i].Base == base && !a[i].Partial {
+			out = append(out, a[i])
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Nearest returns the complete archive with the given base whose creation time
+// is closest to t. If two archives are equally close, the earlier is chosen.
+func (a Archives) Nearest(base string, t time.Time) (Archive, bool) {
+	mid := a.searchTime(t, false)
+	lo, hi := mid-1, mid
+	for lo >= 0 && (a[lo].Base != base || a[lo].Partial) {
+		lo--
+	}
+	for hi < len(a) && (a[hi].Base != base || a[hi].Partial) {
+		hi++
+	}
+	switch {
+	case lo < 0 && hi == len(a):
+		return Archive{}, false
+	case lo < 0:
+		return a[hi], true
+	case hi == len(a):
+		return a[lo], true
+	case a[hi].Created.Sub(t) < t.Sub(a[lo].Created):
+		return a[hi], true
+	default:
+		return a[lo], true
+	}
+}
+
+// Filter returns the archives for which keep reports true.
+func (a Archives) Filter(keep func(Archive) bool) Archives {
+	var out Archives
+	for _, arch := range a {
+		if keep(arch) {
+			out = append(out, arch)
+		}
+	}
+	return out
+}
+
+// Match returns the archives whose names match the glob pattern, using the
+// syntax of path.Match. It reports an error if the pattern is malformed.
+func (a Archives) Match(pattern string) (Archives, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return a.Filter(func(arch Archive) bool {
+		ok, _ := path.Match(pattern, arch.Name)
+		return ok
+	}), nil
+}
+
+// MatchRegexp returns the archives whose names contain a match for re.
+func (a Archives) MatchRegexp(re *regexp.Regexp) Archives {
+	return a.Filter(func(arch Archive) bool { return re.MatchString(arch.Name) })
+}
@@ -0,0 +1,195 @@
+package tarsnap
+
+import (
+	"context"
+	"time"
+)
+
+// A Policy describes which archives to retain. Archives are grouped by Base,
+// and the rules of the policy are applied separately to each group.
+//
+// Within a group, a complete archive is kept if any rule selects it:
+//
+//   - KeepLast selects the most recent archives.
+//   - Hourly, Daily, Weekly, Monthly, and Yearly select the most recent
+//     archive in each of that many of the latest periods of that length in
+//     which archives were created (a "grandfather-father-son" rotation).
+//     Periods are computed in UTC, and weeks are ISO 8601 weeks.
+//
+// The newest complete archive of each group is always kept. Partial archives
+// are not counted by any rule. A partial archive is deleted once a complete
+// archive with the same base has been created after it.
+//
+// MinAge is not a rule but a safety floor: no archive created less than MinAge
+// ago is deleted, whatever the rules select. In JSON and YAML it is written as
+// a string such as "36h".
+//
+// A Policy with no rules set retains every archive, so that an empty policy
+// (or one that sets only MinAge) never deletes anything.
+type Policy struct {
+	KeepLast int `json:"keepLast,omitempty" yaml:"keep-last"`
+	Hourly   int `json:"hourly,omitempty" yaml:"hourly"`
+	Daily    int `json:"daily,omitempty" yaml:"daily"`
+	Weekly   int `json:"weekly,omitempty" yaml:"weekly"`
+	Monthly  int `json:"monthly,omitempty" yaml:"monthly"`
+	Yearly   int `json:"yearly,omitempty" yaml:"yearly"`
+
+	MinAge Duration `json:"minAge,omitempty" yaml:"min-age"`
+
+	// Overrides replace the policy for archives with the given bases. The
+	// Overrides of an override are ignored.
+	Overrides map[string]Policy `json:"overrides,omitempty" yaml:"overrides"`
+}
+
+// isEmpty reports whether p has no rules, ignoring its overrides and MinAge.
+func (p Policy) isEmpty() bool {
+	return p.KeepLast <= 0 && p.Hourly <= 0 && p.Daily <= 0 && p.Weekly <= 0 &&
+		p.Monthly <= 0 && p.Yearly <= 0
+}
+
+// forBase returns the policy that applies to archives with the given base.
+func (p Policy) forBase(base string) Policy {
+	if o, ok := p.Overrides[base]; ok {
+		return o
+	}
+	return p
+}
+
+// periodRules define the bucket rules of a Policy. Each key function maps a
+// time to a value identifying the period containing it.
+var periodRules = []struct {
+	count func(Policy) int
+	key   func(time.Time) int64
+}{
+	{func(p Policy) int { return p.Hourly }, func(t time.Time) int64 { return t.Unix() / 3600 }},
+	{func(p Policy) int { return p.Daily }, func(t time.Time) int64 {
+		return int64(t.Year())*1000 + int64(t.YearDay())
+	}},
+	{func(p Policy) int { return p.Weekly }, func(t time.Time) int64 {
+		y, w := t.ISOWeek()
+		return int64(y)*100 + int64(w)
+	}},
+	{func(p Policy) int { return p.Monthly }, func(t time.Time) int64 {
+		return int64(t.Year())*100 + int64(t.Month())
+	}},
+	{func(p Policy) int { return p.Yearly }, func(t time.Time) int64 { return int64(t.Year()) }},
+}
+
+// Apply partitions archs into the archives that p retains and those that it
+// does not, as of the time now. Each result is in the same relative order as
+// archs, which should be sorted as returned by List.
+func (p Policy) Apply(archs Archives, now time.Time) (keep, drop Archives) {
+	return p.applyBy(archs, now, func(a Archive) string { return a.Base })
+}
+
+// applyBy is as Apply, but groups the archives by the key function rather
+// than by base. The keys are also used to look up overrides.
+func (p Policy) applyBy(archs Archives, now time.Time, key func(Archive) string) (keep, drop Archives) {
+	groups := make(map[string][]int) // key → indexes of archs, in order
+	for i, a := range archs {
+		k := key(a)
+		groups[k] = append(groups[k], i)
+	}
+
+	retain := make([]bool, len(archs))
+	for k, idx := range groups {
+		p.forBase(k).mark(archs, idx, now, retain)
+	}
+	for i, a := range archs {
+		if retain[i] {
+			keep = append(keep, a)
+		} else {
+			drop = append(drop, a)
+		}
+	}
+	return keep, drop
+}
+
+// mark sets retain[i] for each index i in idx whose archive p retains. The
+// archives at idx must form one group and be in nondecreasing order of
+// creation.
+func (p Policy) mark(archs Archives, idx []int, now time.Time, retain []bool) {
+	if p.isEmpty() {
+		for _, i := range idx {
+			retain[i] = true
+		}
+		return
+	}
+
+	// Visit complete archives from newest to oldest.
+	var complete []int
+	for j := len(idx) - 1; j >= 0; j-- {
+		if i := idx[j]; !archs[i].Partial {
+			complete = append(complete, i)
+		}
+	}
+	for j, i := range complete {
+		if j == 0 || j < p.KeepLast {
+			retain[i] = true
+		}
+	}
+	for _, rule := range periodRules {
+		n := rule.count(p)
+		var last int64
+		for j, i := range complete {
+			if n <= 0 {
+				break
+			}
+			k := rule.key(archs[i].Created.UTC())
+			if j == 0 || k != last {
+				retain[i] = true
+				last = k
+				n--
+			}
+		}
+	}
+
+	var newest time.Time // creation time of the newest complete archive
+	if len(complete) != 0 {
+		newest = archs[complete[0]].Created
+	}
+	for _, i := range idx {
+		a := archs[i]
+		if p.MinAge > 0 && now.Sub(a.Created) < time.Duration(p.MinAge) {
+			retain[i] = true // too young to delete
+		} else if a.Partial && !newest.After(a.Created) {
+			retain[i] = true // not yet superseded
+		}
+	}
+}
+
+// A PruneReport describes the effect of applying a Policy to the archives.
+type PruneReport struct {
+	Keep   Archives `json:"keep"`   // archives retained by the policy
+	Delete Archives `json:"delete"` // archives deleted, or to be deleted
+	DryRun bool     `json:"dryRun,omitempty"`
+}
+
+// Prune lists the archives, applies the policy to them as of the current
+// time, and deletes the archives the policy does not retain. If dryRun is
+// true, Prune reports the archives it would delete without deleting them.
+//
+// If deleting fails, Prune returns the report along with the error, and some
+// of the archives in its Delete list may not have been deleted.
+func (c *Config) Prune(policy Policy, dryRun bool) (*PruneReport, error) {
+	return c.PruneContext(context.Background(), policy, dryRun)
+}
+
+// PruneContext is as Prune, but the tarsnap processes are interrupted if ctx
+// ends before they complete.
+func (c *Config) PruneContext(ctx context.Context, policy Policy, dryRun bool) (*PruneReport, error) {
+	archs, err := c.ListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keep, drop := policy.Apply(archs, time.Now())
+	rep := &PruneReport{Keep: keep, Delete: drop, DryRun: dryRun}
+	if dryRun || len(drop) == 0 {
+		return rep, nil
+	}
+	names := make([]string, len(drop))
+	for i, a := range drop {
+		names[i] = a.Name
+	}
+	return rep, c.DeleteContext(ctx, names...)
+}
@@ -0,0 +1,168 @@
+package tarsnap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// A Runner executes commands on behalf of a Config. The default Runner is
+// ExecRunner, which runs each command as a local subprocess. Other
+// implementations may run the command elsewhere (for example via sudo or ssh),
+// or may record or simulate its execution.
+type Runner interface {
+	// Run executes cmd and blocks until it is complete.  If ctx ends before
+	// the command completes, Run should stop the command and return.
+	//
+	// If the command runs but exits with a non-zero status, the error returned
+	// by Run should have a method "ExitCode() int" that reports the status, as
+	// *exec.ExitError does.
+	Run(ctx context.Context, cmd *Command) error
+}
+
+// RunnerFunc implements the Runner interface by calling a function.
+type RunnerFunc func(context.Context, *Command) error
+
+// Run implements the Runner interface by calling f.
+func (f RunnerFunc) Run(ctx context.Context, cmd *Command) error { return f(ctx, cmd) }
+
+// A Command describes a single execution of a command-line tool.
+type Command struct {
+	Name string   // the name or path of the tool to execute
+	Args []string // the command-line arguments, not including Name
+
+	// Additional environment settings for the command, in "key=value" form.
+	// These supplement the environment of the caller.
+	Env []string
+
+	Stdin  io.Reader // if nil, the command has empty input
+	Stdout io.Writer // if nil, output is discarded
+	Stderr io.Writer // if nil, error output is discarded
+}
+
+// interruptGrace is how long a tarsnap process is given to exit after it has
+// been interrupted, before it is forcibly killed.
+const interruptGrace = 10 * time.Second
+
+// ExecRunner is a Runner that executes each command as a local subprocess
+// using the os/exec package. This is the default Runner for a Config.
+//
+// If the context governing a command ends before the command completes, the
+// process is sent an interrupt so that tarsnap can shut down cleanly, and is
+// killed if it does not exit promptly.
+type ExecRunner struct{}
+
+// Run implements the Runner interface.
+func (ExecRunner) Run(ctx context.Context, cmd *Command) error {
+	proc := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	if len(cmd.Env) != 0 {
+		proc.Env = append(os.Environ(), cmd.Env...)
+	}
+	proc.Stdin = cmd.Stdin
+	proc.Stdout = cmd.Stdout
+	proc.Stderr = cmd.Stderr
+	proc.Cancel = func() error { return proc.Process.Signal(os.Interrupt) }
+	proc.WaitDelay = interruptGrace
+	return proc.Run()
+}
+
+func (c *Config) runner() Runner {
+	if c != nil && c.Runner != nil {
+		return c.Runner
+	}
+	return ExecRunner{}
+}
+
+// exec runs the specified tarsnap command using the runner for c. If the
+// command fails, the error reports the cause.
+//
+// If watch != nil, it is called with each line of the error output of the
+// command.  Lines for which watch reports true are not included in the error.
+func (c *Config) exec(ctx context.Context, extra []string, stdin io.Reader, stdout io.Writer, watch func(string) bool) error {
+	cmd, args := c.base(extra...)
+	return c.execTool(ctx, cmd, args, stdin, stdout, watch)
+}
+
+// execTool runs cmd with exactly the specified arguments using the runner for
+// c. Otherwise it behaves as exec.
+func (c *Config) execTool(ctx context.Context, cmd string, args []string, stdin io.Reader, stdout io.Writer, watch func(string) bool) error {
+	c.cmdLog(cmd, args)
+
+	var env []string
+	if c != nil {
+		env = c.Env
+	}
+	ebuf := bytes.NewBuffer(nil)
+	var stderr io.Writer = ebuf
+	var lw *lineWriter
+	if watch != nil {
+		lw = &lineWriter{f: watch, rest: ebuf}
+		stderr = lw
+	}
+	err := c.runner().Run(ctx, &Command{
+		Name:   cmd,
+		Args:   args,
+		Env:    env,
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if lw != nil {
+		lw.flush()
+	}
+	if err == nil {
+		return nil
+	} else if cerr := ctx.Err(); cerr != nil {
+		return interrupted(cerr)
+	} else if e, ok := err.(interface{ ExitCode() int }); ok {
+		return &CommandError{
+			Args:     args,
+			ExitCode: e.ExitCode(),
+			Stderr:   ebuf.String(),
+			Kind:     classifyError(ebuf.String()),
+		}
+	}
+	return fmt.Errorf("failed: %v", err)
+}
+
+// interrupted returns an error reporting that a command was stopped because
+// its context ended with err.
+func interrupted(err error) error { return fmt.Errorf("tarsnap interrupted: %w", err) }
+
+// stream starts the specified tarsnap command and returns a reader for its
+// standard output.  If the command fails, the error is reported by Read once
+// the output is exhausted.  Closing the reader terminates the command if it
+// has not already exited.
+func (c *Config) stream(ctx context.Context, extra []string, stdin io.Reader) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	r := &outputReader{pr: pr, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		pw.CloseWithError(c.exec(ctx, extra, stdin, pw, nil))
+	}()
+	return r
+}
+
+// outputReader reads the output of a command started by Config.stream.
+type outputReader struct {
+	pr     *io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Read implements the io.Reader interface.
+func (r *outputReader) Read(data []byte) (int, error) { return r.pr.Read(data) }
+
+// Close implements the io.Closer interface. It terminates the command if it
+// is still running, and waits for it to exit.
+func (r *outputReader) Close() error {
+	r.cancel()
+	r.pr.Close()
+	<-r.done
+	return nil
+}
@@ -0,0 +1,76 @@
+package tarsnap
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Open returns a reader for the contents of the file at path in the specified
+// archive. It is equivalent in effect to "tarsnap -x -O -f name path", except
+// that path is matched literally rather than as a pattern (see LiteralPattern).
+//
+// The contents are streamed from a tarsnap process as the caller reads them.
+// If the file is not found, or the process fails, the error is reported by
+// Read once the output is exhausted. The caller must close the reader when it
+// is done, which terminates the process if it has not already exited.
+func (c *Config) Open(name, path string) (io.ReadCloser, error) {
+	return c.OpenContext(context.Background(), name, path)
+}
+
+// OpenContext is as Open, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) OpenContext(ctx context.Context, name, path string) (io.ReadCloser, error) {
+	if name == "" {
+		return nil, errors.New("empty archive name")
+	} else if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	// The --fast-read flag stops tarsnap after the first matching entry, so
+	// that the output contains only one file.
+	return c.stream(ctx, []string{"-x", "-O", "--fast-read", "-f", name, "--", LiteralPattern(path)}, nil), nil
+}
+
+// ReadTar returns a reader for the complete contents of the specified archive,
+// as a tar stream. It is equivalent in effect to "tarsnap -r -f name".
+//
+// As with Open, the stream is read from a tarsnap process as the caller
+// consumes it, errors are reported by Read, and the caller must close the
+// reader when it is done. The stream can be decoded with archive/tar.
+func (c *Config) ReadTar(name string) (io.ReadCloser, error) {
+	return c.ReadTarContext(context.Background(), name)
+}
+
+// ReadTarContext is as ReadTar, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) ReadTarContext(ctx context.Context, name string) (io.ReadCloser, error) {
+	if name == "" {
+		return nil, errors.New("empty archive name")
+	}
+	return c.stream(ctx, []string{"-r", "-f", name}, nil), nil
+}
+
+// CreateFromTar creates an archive with the specified name from the entries of
+// a tar stream read from r. It is equivalent in effect to "tarsnap -c -f name
+// opts... @-" with r as the standard input. The entries of r are filtered and
+// renamed by the Exclude and Modify rules of opts. The Include list of opts
+// must be empty, since the stream supplies the entries.
+//
+// This allows an archive to be created from data that do not exist as files,
+// for example by writing to r with the archive/tar package.
+func (c *Config) CreateFromTar(name string, r io.Reader, opts CreateOptions) error {
+	return c.CreateFromTarContext(context.Background(), name, r, opts)
+}
+
+// CreateFromTarContext is as CreateFromTar, but the tarsnap process is
+// interrupted if ctx ends before it completes.
+func (c *Config) CreateFromTarContext(ctx context.Context, name string, r io.Reader, opts CreateOptions) error {
+	if r == nil {
+		return errors.New("nil tar stream")
+	} else if len(opts.Include) != 0 {
+		return errors.New("include list not allowed with a tar stream")
+	}
+	_, err := c.create(ctx, name, opts, []string{"@-"}, r, false)
+	return err
+}
@@ -7,12 +7,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -25,6 +25,12 @@ import (
 // Config carries configuration settings to a tarsnap execution.  A nil *Config
 // is ready for use and provides default settings.
 type Config struct {
+	// The name or path of the tarsnap tool (default "tarsnap").
+	//
+	// The key management tools are found next to it: If the base name of
+	// Tool is "tarsnap", the tool for "keygen" is Tool + "-keygen"; otherwise,
+	// for example with a wrapper script or a versioned binary, it is the file
+	// "tarsnap-keygen" in the same directory as Tool.
 	Tool     string `json:"tool"`
 	Keyfile  string `json:"keyFile"`
 	WorkDir  string `json:"workDir"`
@@ -33,15 +39,64 @@ type Config struct {
 	// Optional settings flags to pass to the tarsnap command-line tool.
 	Flags []Flag `json:"flags"`
 
+	// Additional environment settings for the tarsnap process, in "key=value"
+	// form.
+	Env []string `json:"env,omitempty"`
+
 	// If not nil, this function is called with each tarsnap command-line giving
 	// the full argument list.
 	CmdLog func(cmd string, args []string) `json:"-" yaml:"-"`
+
+	// If not nil, use this to execute tarsnap commands. If nil, commands are
+	// run as local subprocesses (see ExecRunner).
+	Runner Runner `json:"-" yaml:"-"`
+
+	// If set, List caches the list of archives in this file, and reuses it
+	// while the cache tag of the config is unchanged (see CacheTag). The file
+	// is ignored if the cache tag cannot be read.
+	ListCache string `json:"listCache,omitempty" yaml:"list-cache"`
+
+	// If not nil, List parses archive names with this scheme to populate the
+	// Fields of each archive, and CreateNamed uses it to generate names.
+	Naming NamingScheme `json:"-" yaml:"-"`
 }
 
 // List returns a list of the known archives.  The resulting slice is ordered
-// nondecreasing by creation time and by name.
-func (c *Config) List() (Archives, error) {
-	raw, err := c.runOutput([]string{"--list-archives", "-v"})
+// nondecreasing by creation time and by name. If c has a naming scheme, the
+// Fields of each archive whose name matches the scheme are populated.
+//
+// If c has a ListCache, List reuses the archives stored there while the cache
+// tag of c is unchanged. Note that the cache tag reflects only changes made
+// with the cache directory of c, so the cache should not be used if other
+// machines add or delete archives with the same keys.
+func (c *Config) List() (Archives, error) { return c.ListContext(context.Background()) }
+
+// ListContext is as List, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) ListContext(ctx context.Context) (Archives, error) {
+	var archs Archives
+	var err error
+	if c != nil && c.ListCache != "" {
+		archs, err = c.cachedList(ctx)
+	} else {
+		archs, err = c.listArchives(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c != nil && c.Naming != nil {
+		for i, a := range archs {
+			if f, ok := c.Naming.Parse(strings.TrimSuffix(a.Name, partialSuffix)); ok {
+				archs[i].Fields = &f
+			}
+		}
+	}
+	return archs, nil
+}
+
+// listArchives lists the archives known to the tarsnap service.
+func (c *Config) listArchives(ctx context.Context) (Archives, error) {
+	raw, err := c.runOutput(ctx, []string{"--list-archives", "-v"})
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +128,7 @@ func (c *Config) List() (Archives, error) {
 			Base:    parts[0][:i],
 			Tag:     parts[0][i:],
 			Created: when.In(time.UTC),
+			Partial: strings.HasSuffix(parts[0], partialSuffix),
 		})
 	}
 	sort.Sort(archs)
@@ -108,15 +164,92 @@ type CreateOptions struct {
 
 	// Simulate creating archives rather than creating them.
 	DryRun bool `json:"dryRun,omitempty" yaml:"dry-run"`
+
+	// If positive, store a checkpoint each time this many bytes have been
+	// uploaded (as tarsnap --checkpoint-bytes). If the create is interrupted,
+	// the archive is stored up to the latest checkpoint as a partial archive,
+	// with the suffix ".part" appended to its name. The interval must be at
+	// least MinCheckpointBytes.
+	CheckpointBytes int64 `json:"checkpointBytes,omitempty" yaml:"checkpoint-bytes"`
+
+	// Limit the network bandwidth used while creating the archive.
+	RateLimit RateLimits `json:"rateLimit,omitempty" yaml:"rate-limit"`
+
+	// If positive, stop after this many bytes have been uploaded, and store
+	// the archive truncated at that point (as tarsnap --maxbw).
+	MaxUploadBytes int64 `json:"maxUploadBytes,omitempty" yaml:"max-upload-bytes"`
+
+	// Use multiple connections to upload data (as tarsnap --aggressive-networking).
+	AggressiveNetworking bool `json:"aggressiveNetworking,omitempty" yaml:"aggressive-networking"`
+
+	// If positive, pause for this long between storing files, to reduce the
+	// load on the disk (as tarsnap --disk-pause). The resolution is 1ms.
+	// In JSON and YAML the pause is written as a string such as "1500ms".
+	DiskPause Duration `json:"diskPause,omitempty" yaml:"disk-pause"`
+
+	// If not nil, this function is called to report progress as files are
+	// added to the archive.
+	Progress func(Progress) `json:"-" yaml:"-"`
+
+	// If Progress is set, report progress each time this many bytes have been
+	// processed (as tarsnap --progress-bytes). If zero, use DefaultProgressBytes.
+	ProgressBytes int64 `json:"progressBytes,omitempty" yaml:"progress-bytes"`
 }
 
 // Create creates an archive with the specified name and options.
 // It is equivalent in effect to "tarsnap -c -f name opts...".
 func (c *Config) Create(name string, opts CreateOptions) error {
+	return c.CreateContext(context.Background(), name, opts)
+}
+
+// CreateContext is as Create, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) CreateContext(ctx context.Context, name string, opts CreateOptions) error {
+	_, err := c.create(ctx, name, opts, opts.Include, nil, false)
+	return err
+}
+
+// MinCheckpointBytes is the smallest checkpoint interval accepted by tarsnap.
+const MinCheckpointBytes = 1000000
+
+// CreateResult reports storage statistics for a newly-created archive.
+type CreateResult struct {
+	// Sizes for the new archive. The unique sizes report the amount of new
+	// data that was uploaded to store the archive.
+	Archive *Sizes `json:"archive"`
+
+	// Sizes for all archives, including the new one.
+	All *Sizes `json:"all"`
+}
+
+// CreateStats is as Create, but also reports storage statistics for the
+// archive (as tarsnap --print-stats).
+func (c *Config) CreateStats(name string, opts CreateOptions) (*CreateResult, error) {
+	return c.CreateStatsContext(context.Background(), name, opts)
+}
+
+// CreateStatsContext is as CreateStats, but the tarsnap process is interrupted
+// if ctx ends before it completes.
+func (c *Config) CreateStatsContext(ctx context.Context, name string, opts CreateOptions) (*CreateResult, error) {
+	return c.create(ctx, name, opts, opts.Include, nil, true)
+}
+
+// create creates an archive from the specified inputs, and if stats is true
+// reports its sizes. The include list from opts is ignored in favour of inputs.
+// If stdin != nil, it is provided as the standard input to tarsnap.
+func (c *Config) create(ctx context.Context, name string, opts CreateOptions, inputs []string, stdin io.Reader, stats bool) (*CreateResult, error) {
 	if name == "" {
-		return errors.New("empty archive name")
-	} else if len(opts.Include) == 0 {
-		return errors.New("empty include list")
+		return nil, errors.New("empty archive name")
+	} else if len(inputs) == 0 {
+		return nil, errors.New("empty include list")
+	}
+	if opts.CheckpointBytes != 0 && opts.CheckpointBytes < MinCheckpointBytes {
+		return nil, fmt.Errorf("checkpoint interval %d is less than %d bytes",
+			opts.CheckpointBytes, MinCheckpointBytes)
+	}
+	netArgs, err := opts.networkArgs()
+	if err != nil {
+		return nil, err
 	}
 	args := []string{"-c", "-f", name}
 	wd := opts.WorkDir
@@ -141,16 +274,55 @@ func (c *Config) Create(name string, opts CreateOptions) error {
 	if opts.DryRun {
 		args = append(args, "--dry-run")
 	}
+	if opts.CheckpointBytes > 0 {
+		args = append(args, "--checkpoint-bytes", strconv.FormatInt(opts.CheckpointBytes, 10))
+	}
+	args = append(args, netArgs...)
 	for _, mod := range opts.Modify {
 		args = append(args, "-s", mod)
 	}
 	for _, exc := range opts.Exclude {
 		args = append(args, "--exclude", exc)
 	}
-	if len(opts.Include) != 0 {
-		args = append(args, "--")
+	var watch func(string) bool
+	if opts.Progress != nil {
+		args = append(args, progressArgs(opts.ProgressBytes)...)
+		watch = newProgressTracker("a", opts.Progress).line
+	}
+
+	// Statistics for a create are written to the error output after any
+	// progress messages, starting with a "Total size" header. Lines before the
+	// header are not statistics, even if they look like them: a verbose line
+	// for a file whose name ends in two numbers matches the sizes pattern.
+	out := bytes.NewBuffer(nil)
+	if stats {
+		args = append(args, "--print-stats", "--no-humanize-numbers")
+		next := watch
+		var inStats bool
+		watch = func(line string) bool {
+			if !inStats && strings.Contains(line, "Total size") {
+				inStats = true
+			}
+			if inStats && (strings.Contains(line, "Total size") || sizes.MatchString(line)) {
+				fmt.Fprintln(out, line)
+				return true
+			}
+			return next != nil && next(line)
+		}
+	}
+	args = append(args, "--")
+	if err := c.exec(ctx, append(args, inputs...), stdin, out, watch); err != nil {
+		return nil, err
+	} else if !stats {
+		return nil, nil
 	}
-	return c.run(append(args, opts.Include...))
+	info, err := maybeParseSizeInfo(out.Bytes(), nil)
+	if err != nil {
+		return nil, err
+	} else if info.All == nil || info.Archive[thisArchive] == nil {
+		return nil, errors.New("missing archive statistics")
+	}
+	return &CreateResult{Archive: info.Archive[thisArchive], All: info.All}, nil
 }
 
 // ExtractOptions control the extraction of archives.
@@ -158,6 +330,7 @@ type ExtractOptions struct {
 	// Include files matching these globs in the output.  If this is empty, the
 	// whole archive is extracted except for any exclusions. If not, only the
 	// files or directories specified are extracted, modulo exclusions.
+	// Use LiteralPattern to select an entry name that contains wildcards.
 	Include []string `json:"include"`
 
 	// Exclude files or directories matching these patterns.
@@ -179,14 +352,33 @@ type ExtractOptions struct {
 	// match by size and timestamp in the destination.
 	Resume bool `json:"resume" yaml:"resume"`
 
+	// Limit the network bandwidth used while extracting the archive.
+	RateLimit RateLimits `json:"rateLimit,omitempty" yaml:"rate-limit"`
+
+	// If not nil, this function is called to report progress as files are
+	// extracted from the archive.
+	Progress func(Progress) `json:"-" yaml:"-"`
+
+	// If Progress is set, report progress each time this many bytes have been
+	// processed (as tarsnap --progress-bytes). If zero, use DefaultProgressBytes.
+	ProgressBytes int64 `json:"progressBytes,omitempty" yaml:"progress-bytes"`
+
 	// TODO: Consider -k, --chroot, -m, -P
 }
 
 // Extract extracts from an archive with the specified name and options.
 // It is equivalent in effect to "tarsnap -x -f name opts...".
 func (c *Config) Extract(name string, opts ExtractOptions) error {
+	return c.ExtractContext(context.Background(), name, opts)
+}
+
+// ExtractContext is as Extract, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) ExtractContext(ctx context.Context, name string, opts ExtractOptions) error {
 	if name == "" {
 		return errors.New("empty archive name")
+	} else if err := opts.RateLimit.validate(); err != nil {
+		return err
 	}
 
 	args := []string{"-x", "-f", name}
@@ -218,19 +410,31 @@ func (c *Config) Extract(name string, opts ExtractOptions) error {
 	if opts.Resume {
 		args = append(args, "--resume-extract")
 	}
+	args = append(args, opts.RateLimit.args()...)
 	for _, exc := range opts.Exclude {
 		args = append(args, "--exclude", exc)
 	}
+	var watch func(string) bool
+	if opts.Progress != nil {
+		args = append(args, progressArgs(opts.ProgressBytes)...)
+		watch = newProgressTracker("x", opts.Progress).line
+	}
 	if len(opts.Include) != 0 {
 		args = append(args, "--")
 	}
-	return c.run(append(args, opts.Include...))
+	return c.exec(ctx, append(args, opts.Include...), nil, nil, watch)
 }
 
 // Entries calls f with each entry stored in the specified archive.
 // If f reports an error, scanning stops and that error is returned to the
 // caller of contents.
-func (c *Config) Entries(name string, f func(*Entry) error) (err error) {
+func (c *Config) Entries(name string, f func(*Entry) error) error {
+	return c.EntriesContext(context.Background(), name, f)
+}
+
+// EntriesContext is as Entries, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) EntriesContext(ctx context.Context, name string, f func(*Entry) error) error {
 	if name == "" {
 		return errors.New("empty archive name")
 	}
@@ -238,34 +442,12 @@ func (c *Config) Entries(name string, f func(*Entry) error) (err error) {
 	// The -v flag is needed to ensure the output contains stat.
 	// The --numeric-owner flag ensures owner/group are not converted to names.
 	// The --iso-dates flag ensures we get seconds precision on timestamps.
-	cmd, args := c.base("-v", "--iso-dates", "--numeric-owner", "-t", "-f", name)
-	c.cmdLog(cmd, args)
-
-	// Ensure the subprocess is terminated on return, since the caller may not
+	//
+	// Closing the output terminates the subprocess, since the caller may not
 	// fully consume the output.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	proc := exec.CommandContext(ctx, cmd, args...)
-	ebuf := bytes.NewBuffer(nil)
-	proc.Stderr = ebuf
-	out, err := proc.StdoutPipe()
-	if err != nil {
-		return err
-	}
+	out := c.stream(ctx, []string{"-v", "--iso-dates", "--numeric-owner", "-t", "-f", name}, nil)
 	defer out.Close()
 
-	if err := proc.Start(); err != nil {
-		return err
-	}
-	defer func() {
-		cancel() // the deferred cancel above happens after this
-		werr := proc.Wait()
-		if werr != nil && err == nil {
-			err = errors.New(strings.SplitN(ebuf.String(), "\n", 2)[0])
-		}
-	}()
-
 	s := bufio.NewScanner(out)
 	for s.Scan() {
 		e, err := parseEntry(s.Text())
@@ -275,24 +457,74 @@ func (c *Config) Entries(name string, f func(*Entry) error) (err error) {
 			return err
 		}
 	}
-	if err := s.Err(); err != io.EOF {
-		return err
-	}
-	return nil
+	return s.Err()
 }
 
 // An Entry describes a single file or directory entry stored in an archive.
+//
+// In JSON, Mode is encoded as a string of the form "drwxr-xr-x", in which the
+// first character gives the file type as tarsnap lists it ("-" for a regular
+// file, "d" for a directory, "l" for a symbolic link, and so on).
 type Entry struct {
-	Mode         os.FileMode
-	Owner, Group int
-	Size         int64     // in bytes
-	ModTime      time.Time // in UTC
-	Name         string
+	Mode    os.FileMode `json:"mode"`
+	Nlink   int         `json:"nlink"` // the link count, as recorded in the archive
+	Owner   int         `json:"owner"`
+	Group   int         `json:"group"`
+	Size    int64       `json:"size"`    // in bytes
+	ModTime time.Time   `json:"modTime"` // in UTC
+	Name    string      `json:"name"`
+
+	LinkTarget string `json:"linkTarget,omitempty"` // for a symbolic link, the target of the link
+	HardLinkTo string `json:"hardLinkTo,omitempty"` // for a hard link, the name of the linked entry
+
+	// For a device, the major and minor device numbers. Tarsnap lists these
+	// in place of the size, so Size is 0 for a device.
+	DevMajor int64 `json:"devMajor,omitempty"`
+	DevMinor int64 `json:"devMinor,omitempty"`
 }
 
 func (e *Entry) String() string {
-	return fmt.Sprintf("%v uid=%d gid=%d size=%d %v %q",
-		e.Mode, e.Owner, e.Group, e.Size, e.ModTime, e.Name)
+	size := fmt.Sprintf("size=%d", e.Size)
+	if e.Mode&os.ModeDevice != 0 {
+		size = fmt.Sprintf("dev=%d,%d", e.DevMajor, e.DevMinor)
+	}
+	s := fmt.Sprintf("%v uid=%d gid=%d %s %v %q",
+		e.Mode, e.Owner, e.Group, size, e.ModTime, e.Name)
+	if e.LinkTarget != "" {
+		s += fmt.Sprintf(" -> %q", e.LinkTarget)
+	} else if e.HardLinkTo != "" {
+		s += fmt.Sprintf(" link to %q", e.HardLinkTo)
+	}
+	return s
+}
+
+// MarshalJSON encodes e as a JSON object, with the mode as a string.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type plain Entry
+	p := plain(e)
+	return json.Marshal(struct {
+		Mode string `json:"mode"`
+		*plain
+	}{formatMode(e.Mode), &p})
+}
+
+// UnmarshalJSON decodes e from a JSON object encoded by MarshalJSON.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	type plain Entry
+	var v struct {
+		Mode string `json:"mode"`
+		*plain
+	}
+	v.plain = (*plain)(e)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	mode, err := parseMode(v.Mode)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q: %w", v.Mode, err)
+	}
+	e.Mode = mode
+	return nil
 }
 
 var spaces = regexp.MustCompile(" +")
@@ -314,38 +546,122 @@ func parseEntry(s string) (*Entry, error) {
 		return nil, fmt.Errorf("entry %q: invalid mtime: %v", s, err)
 	}
 
+	// Symbolic links are listed as "name -> target", and hard links as "name
+	// link to target". Since a name may itself contain these separators, split
+	// only entries whose type says they are links.
+	name := parts[7]
+	e := &Entry{Mode: mode}
+	switch parts[0][0] {
+	case 'l', 'L':
+		name, e.LinkTarget, _ = strings.Cut(name, " -> ")
+	case 'h':
+		name, e.HardLinkTo, _ = strings.Cut(name, " link to ")
+	}
+
 	// Directory names are stored with a trailing "/"; remove this for the entry.
-	e := &Entry{Mode: mode, Name: strings.TrimSuffix(parts[7], "/")}
+	e.Name = unescapeName(strings.TrimSuffix(name, "/"))
+	e.LinkTarget = unescapeName(e.LinkTarget)
+	e.HardLinkTo = unescapeName(e.HardLinkTo)
+	e.Nlink, _ = strconv.Atoi(parts[1])
 	e.Owner, _ = strconv.Atoi(parts[2])
 	e.Group, _ = strconv.Atoi(parts[3])
-	e.Size, _ = strconv.ParseInt(parts[4], 10, 64)
+	if maj, min, ok := strings.Cut(parts[4], ","); ok && mode&os.ModeDevice != 0 {
+		// Devices are listed with "major,minor" in place of the size.
+		if e.DevMajor, err = strconv.ParseInt(maj, 10, 64); err == nil {
+			e.DevMinor, err = strconv.ParseInt(min, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: invalid device number: %v", s, err)
+		}
+	} else {
+		e.Size, _ = strconv.ParseInt(parts[4], 10, 64)
+	}
 	e.ModTime = mtime.In(time.UTC)
 	return e, nil
 }
 
 // parseMode parses the file mode from a 10-character string of the form
-// trwxrwxrwx.
+// trwxrwxrwx, as produced by libarchive. The string may have an 11th character
+// marking the presence of ACLs or extended attributes, which is ignored.
 func parseMode(s string) (os.FileMode, error) {
+	if len(s) == 11 && strings.IndexByte("+@. ", s[10]) >= 0 {
+		s = s[:10]
+	}
 	if len(s) != 10 {
 		return 0, errors.New("invalid mode string")
 	}
 	var mode os.FileMode
 	switch s[0] {
-	case '-':
+	case '-', 'h':
 		// do nothing; this is the default mode
+		// N.B. A hard link ('h') is stored as a regular file.
 	case 'd':
 		mode |= os.ModeDir
 	case 'L', 'l':
 		mode |= os.ModeSymlink
+	case 'c':
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		mode |= os.ModeDevice
+	case 'p':
+		mode |= os.ModeNamedPipe
+	case 's':
+		mode |= os.ModeSocket
 	default:
 		return 0, fmt.Errorf("unknown mode type %q", s)
 	}
 	mode |= parseRWX(s[1:], 6, os.ModeSetuid) |
 		parseRWX(s[4:], 3, os.ModeSetgid) |
-		parseRWX(s[7:], 0, 0)
+		parseRWX(s[7:], 0, os.ModeSticky)
 	return mode, nil
 }
 
+// formatMode formats mode as a 10-character string of the form trwxrwxrwx, in
+// the format accepted by parseMode.
+func formatMode(mode os.FileMode) string {
+	var buf [10]byte
+	switch {
+	case mode&os.ModeDir != 0:
+		buf[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		buf[0] = 'l'
+	case mode&os.ModeCharDevice != 0:
+		buf[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		buf[0] = 'b'
+	case mode&os.ModeNamedPipe != 0:
+		buf[0] = 'p'
+	case mode&os.ModeSocket != 0:
+		buf[0] = 's'
+	default:
+		buf[0] = '-'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := range 9 {
+		if mode&(1<<(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		} else {
+			buf[i+1] = '-'
+		}
+	}
+	special := func(pos int, bit os.FileMode, set, unset byte) {
+		if mode&bit != 0 {
+			if buf[pos] == 'x' {
+				buf[pos] = set
+			} else {
+				buf[pos] = unset
+			}
+		}
+	}
+	special(3, os.ModeSetuid, 's', 'S')
+	special(6, os.ModeSetgid, 's', 'S')
+	special(9, os.ModeSticky, 't', 'T')
+	return string(buf[:])
+}
+
+// parseRWX parses a 3-character permission string of the form rwx.  The third
+// character may also be "s" or "t" (executable, and setBit is set) or "S" or
+// "T" (not executable, and setBit is set).
 func parseRWX(s string, shift, setBit os.FileMode) (rwx os.FileMode) {
 	const modeRead = 4
 	const modeWrite = 2
@@ -357,10 +673,12 @@ func parseRWX(s string, shift, setBit os.FileMode) (rwx os.FileMode) {
 	if s[1] == 'w' {
 		rwx |= modeWrite << shift
 	}
-	if s[2] == 'x' || s[2] == 's' {
+	switch s[2] {
+	case 'x':
 		rwx |= modeExec << shift
-	}
-	if s[2] == 's' || s[2] == 'S' {
+	case 's', 't':
+		rwx |= modeExec<<shift | setBit
+	case 'S', 'T':
 		rwx |= setBit
 	}
 	return
@@ -368,21 +686,33 @@ func parseRWX(s string, shift, setBit os.FileMode) (rwx os.FileMode) {
 
 // Delete deletes the specified archives.
 func (c *Config) Delete(archives ...string) error {
+	return c.DeleteContext(context.Background(), archives...)
+}
+
+// DeleteContext is as Delete, but the tarsnap process is interrupted if ctx
+// ends before it completes.
+func (c *Config) DeleteContext(ctx context.Context, archives ...string) error {
 	args := []string{"-d"}
 	for _, a := range archives {
 		args = append(args, "-f", a)
 	}
-	return c.run(args)
+	return c.run(ctx, args)
 }
 
 // Size reports storage sizes for the specified archives.  If no archives are
 // specified only global stats are reported.
 func (c *Config) Size(archives ...string) (*SizeInfo, error) {
+	return c.SizeContext(context.Background(), archives...)
+}
+
+// SizeContext is as Size, but the tarsnap process is interrupted if ctx ends
+// before it completes.
+func (c *Config) SizeContext(ctx context.Context, archives ...string) (*SizeInfo, error) {
 	args := []string{"--print-stats", "--no-humanize-numbers"}
 	for _, arch := range archives {
 		args = append(args, "-f", arch)
 	}
-	return maybeParseSizeInfo(c.runOutput(args))
+	return maybeParseSizeInfo(c.runOutput(ctx, args))
 }
 
 // Sizes represents storage size values.
@@ -404,18 +734,23 @@ func (s *Sizes) String() string {
 
 // SizeInfo records storage size information for archives.
 type SizeInfo struct {
-	All     *Sizes            // sizes for all archives known
-	Archive map[string]*Sizes // sizes for individual archives
+	All     *Sizes            `json:"all,omitempty"`     // sizes for all archives known
+	Archive map[string]*Sizes `json:"archive,omitempty"` // sizes for individual archives
 }
 
 var sizes = regexp.MustCompile(`^\s*(.*?)\s+(\d+)\s+(\d+)$`)
 
+// thisArchive is the name tarsnap -c --print-stats uses for the sizes of the
+// newly-created archive.
+const thisArchive = "This archive"
+
 func maybeParseSizeInfo(data []byte, err error) (*SizeInfo, error) {
 	if err != nil {
 		return nil, err
 	}
 	info := &SizeInfo{Archive: make(map[string]*Sizes)}
 	var cur *Sizes
+	var last string // the tag of the previous block
 	for i, line := range strings.Split(string(data), "\n") {
 		m := sizes.FindStringSubmatch(line)
 		if m == nil {
@@ -437,8 +772,13 @@ func maybeParseSizeInfo(data []byte, err error) (*SizeInfo, error) {
 
 		// If the name is "All archives", this is a summary stats block.
 		// If the name is "(unique data)", this is a continuation block.
+		// If the name is "New data" following "This archive", this is the
+		// continuation block for a newly-created archive.
 		// Otherwise, this is an archive-specific block.
-		switch tag := m[1]; tag {
+		tag := m[1]
+		prev := last
+		last = tag
+		switch tag {
 		case "All archives":
 			cur = &Sizes{
 				InputBytes:      total,
@@ -454,6 +794,15 @@ func maybeParseSizeInfo(data []byte, err error) (*SizeInfo, error) {
 			cur.CompressedUniqueBytes = comp
 			cur = nil
 
+		case "New data":
+			if prev == thisArchive && cur != nil {
+				cur.UniqueBytes = total
+				cur.CompressedUniqueBytes = comp
+				cur = nil
+				break
+			}
+			fallthrough
+
 		default:
 			cur = &Sizes{InputBytes: total, CompressedBytes: comp}
 			info.Archive[tag] = cur
@@ -465,11 +814,8 @@ func maybeParseSizeInfo(data []byte, err error) (*SizeInfo, error) {
 func (c *Config) base(rest ...string) (string, []string) {
 	base := c.addFlags([]string{"--quiet", "--no-print-stats"}, rest)
 
-	cmd := "tarsnap"
+	cmd := c.tool("")
 	if c != nil {
-		if c.Tool != "" {
-			cmd = c.Tool
-		}
 		if c.Keyfile != "" {
 			base = append(base, "--keyfile", c.Keyfile)
 		}
@@ -480,21 +826,32 @@ func (c *Config) base(rest ...string) (string, []string) {
 	return cmd, append(base, rest...)
 }
 
-func (c *Config) run(args []string) error {
-	_, err := c.runOutput(args)
+// tool returns the name of the tarsnap tool, or if suffix != "" the name of
+// the companion tool with that suffix, e.g., "tarsnap-keygen".
+func (c *Config) tool(suffix string) string {
+	cmd := "tarsnap"
+	if c != nil && c.Tool != "" {
+		cmd = c.Tool
+	}
+	if suffix == "" {
+		return cmd
+	} else if filepath.Base(cmd) == "tarsnap" {
+		return cmd + "-" + suffix
+	}
+	return filepath.Join(filepath.Dir(cmd), "tarsnap-"+suffix)
+}
+
+func (c *Config) run(ctx context.Context, args []string) error {
+	_, err := c.runOutput(ctx, args)
 	return err
 }
 
-func (c *Config) runOutput(extra []string) ([]byte, error) {
-	cmd, args := c.base(extra...)
-	c.cmdLog(cmd, args)
-	out, err := exec.Command(cmd, args...).Output()
-	if err == nil {
-		return out, nil
-	} else if e, ok := err.(*exec.ExitError); ok {
-		return nil, errors.New(strings.SplitN(string(e.Stderr), "\n", 2)[0])
+func (c *Config) runOutput(ctx context.Context, extra []string) ([]byte, error) {
+	out := bytes.NewBuffer(nil)
+	if err := c.exec(ctx, extra, nil, out, nil); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("failed: %v", err)
+	return out.Bytes(), nil
 }
 
 func (c *Config) cmdLog(cmd string, args []string) {
@@ -509,8 +866,20 @@ type Archive struct {
 	Base    string    `json:"base,omitempty"`    // base alone
 	Tag     string    `json:"tag,omitempty"`     // .tag alone
 	Created time.Time `json:"created,omitempty"` // in UTC
+
+	// Partial is true if the archive is incomplete: It was stored from a
+	// checkpoint or truncated when its creation was interrupted. Tarsnap
+	// marks such archives by appending ".part" to the name.
+	Partial bool `json:"partial,omitempty"`
+
+	// Fields are the fields parsed from the name by the naming scheme of the
+	// Config that listed the archive, or nil if the name does not match.
+	Fields *NameFields `json:"fields,omitempty"`
 }
 
+// partialSuffix is the suffix tarsnap appends to the names of partial archives.
+const partialSuffix = ".part"
+
 // Archives is a sortable slice of Archive values, ordered non-decreasing by
 // creation time with ties broken by name.
 type Archives []Archive
@@ -525,15 +894,15 @@ func (a Archives) Less(i, j int) bool {
 	return a[i].Created.Before(a[j].Created)
 }
 
-// Latest returns the most recently-created archive with the given base.  It is
-// shorthand for LatestAsOf(base, time.Now()).
+// Latest returns the most recently-created complete archive with the given
+// base.  It is shorthand for LatestAsOf(base, time.Now()).
 func (a Archives) Latest(base string) (Archive, bool) { return a.LatestAsOf(base, time.Now()) }
 
 // LatestAsOf returns the most recently-created archive with the given base at
-// or before the specified time.
+// or before the specified time. Partial archives are skipped.
 func (a Archives) LatestAsOf(base string, when time.Time) (Archive, bool) {
-	for i := len(a) - 1; i >= 0; i-- {
-		if a[i].Base == base && !a[i].Created.After(when) {
+	for i := a.searchTime(when, true) - 1; i >= 0; i-- {
+		if a[i].Base == base && !a[i].Partial {
 			return a[i], true
 		}
 	}
@@ -3,10 +3,18 @@
 package tarsnap
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -110,6 +118,787 @@ func TestRoundTrip(t *testing.T) {
 	}
 }
 
+func TestContextCancel(t *testing.T) {
+	// Use a stand-in for the tool that blocks until it is interrupted.
+	tool := filepath.Join(t.TempDir(), "fake-tarsnap")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\nexec sleep 30\n"), 0700); err != nil {
+		t.Fatalf("Writing fake tool: %v", err)
+	}
+	cfg := &Config{Tool: tool}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cfg.ListContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ListContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("ListContext took %v to return after cancellation", d)
+	}
+
+	if err := cfg.EntriesContext(ctx, "whatever", func(e *Entry) error {
+		t.Errorf("Unexpected entry: %v", e)
+		return nil
+	}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("EntriesContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	var got []string
+	cfg := &Config{
+		Tool:    "my-tarsnap",
+		Keyfile: "/path/to/keyfile",
+		Env:     []string{"TZ=UTC"},
+		Runner: RunnerFunc(func(_ context.Context, cmd *Command) error {
+			got = append([]string{cmd.Name}, cmd.Args...)
+			if len(cmd.Env) != 1 || cmd.Env[0] != "TZ=UTC" {
+				t.Errorf("Command env: got %q, want [TZ=UTC]", cmd.Env)
+			}
+			fmt.Fprint(cmd.Stdout, "beta.1\t2019-08-26 18:30:46\nalpha.2\t2019-08-26 18:30:45\n")
+			return nil
+		}),
+	}
+	archs, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	want := []string{"my-tarsnap", "--quiet", "--no-print-stats", "--keyfile", "/path/to/keyfile",
+		"--list-archives", "-v"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Command line (-want, +got):\n%s", diff)
+	}
+	var names []string
+	for _, a := range archs {
+		names = append(names, a.Name)
+	}
+	if diff := cmp.Diff([]string{"alpha.2", "beta.1"}, names); diff != "" {
+		t.Errorf("Archive names (-want, +got):\n%s", diff)
+	}
+
+	// Verify that failures are reported from the error output.
+	cfg.Runner = RunnerFunc(func(_ context.Context, cmd *Command) error {
+		fmt.Fprintln(cmd.Stderr, "tarsnap: something bad happened")
+		return exitError(1)
+	})
+	if err := cfg.Delete("whatever"); err == nil {
+		t.Error("Delete: got nil error, want failure")
+	} else if got, want := err.Error(), "tarsnap: something bad happened"; got != want {
+		t.Errorf("Delete: got error %q, want %q", got, want)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   error
+	}{
+		{"", nil},
+		{"tarsnap: something unusual\n", nil},
+		{"tarsnap: Archive does not exist: foo\n", ErrArchiveNotFound},
+		{`tarsnap: An archive already exists with the name "foo"`, ErrArchiveExists},
+		{"tarsnap: Cannot read key file: /no/such/key: No such file or directory\n", ErrKeyFile},
+		{"tarsnap: Sequence number mismatch: Run --fsck\n", ErrCacheOutOfSync},
+		{"tarsnap: Error connecting to v1-0-0-server.tarsnap.com: Connection refused\n", ErrNetwork},
+		{"tarsnap: Connection lost, waiting 2 seconds before reconnecting\n", ErrNetwork},
+		{"tarsnap: The write keys are required for this operation\n", ErrKeyPermission},
+	}
+	for _, test := range tests {
+		if got := classifyError(test.stderr); got != test.want {
+			t.Errorf("classifyError(%q): got %v, want %v", test.stderr, got, test.want)
+		}
+	}
+
+	// Verify that a command error is classified and carries its details.
+	cfg := &Config{Runner: RunnerFunc(func(_ context.Context, cmd *Command) error {
+		fmt.Fprintln(cmd.Stderr, "tarsnap: Archive does not exist: foo")
+		fmt.Fprintln(cmd.Stderr, "tarsnap: Error exit delayed from previous errors.")
+		return exitError(1)
+	})}
+	err := cfg.Delete("foo")
+	if !errors.Is(err, ErrArchiveNotFound) {
+		t.Errorf("Delete: got error %v, want %v", err, ErrArchiveNotFound)
+	}
+	var cerr *CommandError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Delete: got error %T, want *CommandError", err)
+	}
+	if cerr.ExitCode != 1 {
+		t.Errorf("Exit code: got %d, want 1", cerr.ExitCode)
+	}
+	if got, want := strings.Count(cerr.Stderr, "\n"), 2; got != want {
+		t.Errorf("Stderr: got %d lines, want %d:\n%s", got, want, cerr.Stderr)
+	}
+}
+
+func TestToolName(t *testing.T) {
+	tests := []struct {
+		tool, suffix, want string
+	}{
+		{"", "", "tarsnap"},
+		{"", "keygen", "tarsnap-keygen"},
+		{"/opt/bin/tarsnap", "keymgmt", "/opt/bin/tarsnap-keymgmt"},
+		{"/opt/bin/tarsnap-1.0.40", "", "/opt/bin/tarsnap-1.0.40"},
+		{"/opt/bin/tarsnap-1.0.40", "keygen", "/opt/bin/tarsnap-keygen"},
+		{"/usr/local/libexec/snapwrap", "recrypt", "/usr/local/libexec/tarsnap-recrypt"},
+		{"snapwrap", "keyregen", "tarsnap-keyregen"},
+	}
+	for _, test := range tests {
+		c := &Config{Tool: test.tool}
+		if got := c.tool(test.suffix); got != test.want {
+			t.Errorf("Config{Tool: %q}.tool(%q): got %q, want %q", test.tool, test.suffix, got, test.want)
+		}
+	}
+}
+
+func TestKeyTools(t *testing.T) {
+	var got []string
+	var input string
+	cfg := &Config{
+		Tool:    "/opt/bin/tarsnap",
+		Keyfile: "/etc/master.key",
+		Runner: RunnerFunc(func(_ context.Context, cmd *Command) error {
+			got = append([]string{cmd.Name}, cmd.Args...)
+			input = ""
+			if cmd.Stdin != nil {
+				data, _ := io.ReadAll(cmd.Stdin)
+				input = string(data)
+			}
+			return nil
+		}),
+	}
+	tests := []struct {
+		name      string
+		run       func() error
+		want      []string
+		wantInput string
+	}{
+		{"Keygen", func() error {
+			return cfg.Keygen(KeygenOptions{
+				User:              "user@example.com",
+				Machine:           "host",
+				Password:          "hunter2",
+				PassphraseOptions: PassphraseOptions{Passphrased: true, MaxTime: Duration(1500 * time.Millisecond)},
+			})
+		}, []string{"/opt/bin/tarsnap-keygen", "--keyfile", "/etc/master.key",
+			"--user", "user@example.com", "--machine", "host",
+			"--passphrased", "--passphrase-time", "1.5"}, "hunter2\n"},
+
+		{"Keymgmt", func() error {
+			return cfg.Keymgmt(KeymgmtOptions{Output: "/etc/backup.key", Perms: KeyWrite | KeyRead})
+		}, []string{"/opt/bin/tarsnap-keymgmt", "--outkeyfile", "/etc/backup.key", "-r", "-w",
+			"/etc/master.key"}, ""},
+
+		{"Recrypt", func() error {
+			return cfg.Recrypt(RecryptOptions{
+				OldKeyfile: "old.key", OldCacheDir: "old-cache",
+				NewKeyfile: "new.key", NewCacheDir: "new-cache",
+			})
+		}, []string{"/opt/bin/tarsnap-recrypt", "--oldkey", "old.key", "--oldcachedir", "old-cache",
+			"--newkey", "new.key", "--newcachedir", "new-cache"}, ""},
+
+		{"KeyPasswd", func() error {
+			return cfg.KeyPasswd(KeyPasswdOptions{
+				Output:            "/etc/new.key",
+				PassphraseOptions: PassphraseOptions{Passphrased: true, MaxMemory: 1 << 20},
+			})
+		}, []string{"/opt/bin/tarsnap-key-passwd", "--keyfile", "/etc/master.key",
+			"--outkeyfile", "/etc/new.key", "--passphrased", "--passphrase-mem", "1048576"}, ""},
+	}
+	for _, test := range tests {
+		if err := test.run(); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s command (-want, +got):\n%s", test.name, diff)
+		}
+		if input != test.wantInput {
+			t.Errorf("%s input: got %q, want %q", test.name, input, test.wantInput)
+		}
+	}
+
+	if err := cfg.Keymgmt(KeymgmtOptions{Output: "x.key"}); err == nil {
+		t.Error("Keymgmt with no permissions succeeded unexpectedly")
+	}
+	if got, want := (KeyRead | KeyNuke).String(), "read|nuke"; got != want {
+		t.Errorf("KeyPerm string: got %q, want %q", got, want)
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	var got []string
+	cfg := &Config{Runner: RunnerFunc(func(_ context.Context, cmd *Command) error {
+		got = cmd.Args
+		return nil
+	})}
+	if err := cfg.Create("test", CreateOptions{
+		Include:              []string{"."},
+		RateLimit:            RateLimits{Up: 50000, Down: 100000},
+		MaxUploadBytes:       1 << 30,
+		AggressiveNetworking: true,
+		DiskPause:            Duration(1500 * time.Microsecond),
+	}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	want := []string{"--maxbw-rate-up", "50000", "--maxbw-rate-down", "100000",
+		"--maxbw", "1073741824", "--aggressive-networking", "--disk-pause", "2"}
+	if i := slices.Index(got, want[0]); i < 0 || !slices.Equal(got[i:i+len(want)], want) {
+		t.Errorf("Create args: got %q, want to contain %q", got, want)
+	}
+
+	if err := cfg.Extract("test", ExtractOptions{RateLimit: RateLimits{Rate: 20000}}); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if !slices.Contains(got, "--maxbw-rate") {
+		t.Errorf("Extract args: got %q, want --maxbw-rate", got)
+	}
+
+	got = nil
+	if err := cfg.Create("test", CreateOptions{
+		Include:   []string{"."},
+		RateLimit: RateLimits{Rate: 100},
+	}); err == nil {
+		t.Error("Create with a low rate limit succeeded unexpectedly")
+	}
+	if err := cfg.Create("test", CreateOptions{
+		Include:   []string{"."},
+		DiskPause: Duration(-time.Second),
+	}); err == nil {
+		t.Error("Create with a negative disk pause succeeded unexpectedly")
+	}
+	if err := cfg.Extract("test", ExtractOptions{RateLimit: RateLimits{Down: 1}}); err == nil {
+		t.Error("Extract with a low rate limit succeeded unexpectedly")
+	}
+	if got != nil {
+		t.Errorf("Invalid options ran a command: %q", got)
+	}
+}
+
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+func TestParseSizeInfo(t *testing.T) {
+	const input = `                                       Total size  Compressed size
+All archives                               104970          102848
+  (unique data)                             54970           52848
+This archive                                 2373             2487
+New data                                     1373             1487
+`
+	info, err := maybeParseSizeInfo([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("Parsing size info: %v", err)
+	}
+	want := &SizeInfo{
+		All: &Sizes{
+			InputBytes:            104970,
+			CompressedBytes:       102848,
+			UniqueBytes:           54970,
+			CompressedUniqueBytes: 52848,
+		},
+		Archive: map[string]*Sizes{
+			thisArchive: {
+				InputBytes:            2373,
+				CompressedBytes:       2487,
+				UniqueBytes:           1373,
+				CompressedUniqueBytes: 1487,
+			},
+		},
+	}
+	if diff := cmp.Diff(want, info); diff != "" {
+		t.Errorf("Size info (-want, +got):\n%s", diff)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  os.FileMode
+	}{
+		{"-rw-r--r--", 0644},
+		{"-rw-r--r--+", 0644},
+		{"hrw-r--r--", 0644},
+		{"drwxr-xr-x", os.ModeDir | 0755},
+		{"lrwxrwxrwx", os.ModeSymlink | 0777},
+		{"crw-rw-rw-", os.ModeDevice | os.ModeCharDevice | 0666},
+		{"brw-rw----", os.ModeDevice | 0660},
+		{"prw-r--r--", os.ModeNamedPipe | 0644},
+		{"srwxrwxrwx", os.ModeSocket | 0777},
+		{"drwxrwxrwt", os.ModeDir | os.ModeSticky | 0777},
+		{"drwxrwxrwT", os.ModeDir | os.ModeSticky | 0776},
+		{"-rwsr-xr-x", os.ModeSetuid | 0755},
+		{"-rwSr--r--", os.ModeSetuid | 0644},
+		{"-rwxr-sr-x", os.ModeSetgid | 0755},
+	}
+	for _, test := range tests {
+		got, err := parseMode(test.input)
+		if err != nil {
+			t.Errorf("parseMode(%q): unexpected error: %v", test.input, err)
+		} else if got != test.want {
+			t.Errorf("parseMode(%q): got %v, want %v", test.input, got, test.want)
+		}
+
+		// Except for ACL markers and hard links, formatMode is the inverse.
+		if len(test.input) == 10 && test.input[0] != 'h' {
+			if got := formatMode(test.want); got != test.input {
+				t.Errorf("formatMode(%v): got %q, want %q", test.want, got, test.input)
+			}
+		}
+	}
+	for _, bad := range []string{"", "?rw-r--r--", "-rw-r--r", "-rw-r--r--xx"} {
+		if got, err := parseMode(bad); err == nil {
+			t.Errorf("parseMode(%q): got %v, want error", bad, got)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var d Duration
+	if err := d.Set("1h30m"); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	} else if d != Duration(90*time.Minute) {
+		t.Errorf("Set: got %v, want 1h30m", d)
+	}
+	if text, err := d.MarshalText(); err != nil || string(text) != "1h30m0s" {
+		t.Errorf("MarshalText: got %q, %v; want 1h30m0s", text, err)
+	}
+	for _, bad := range []string{"", "90", "1 hour"} {
+		if err := d.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText(%q): got nil, want error", bad)
+		}
+	}
+}
+
+func TestEntryJSON(t *testing.T) {
+	e := Entry{
+		Mode:       os.ModeSymlink | 0777,
+		Nlink:      1,
+		Size:       5,
+		ModTime:    time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Name:       "current",
+		LinkTarget: "data",
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("Marshal: unexpected error: %v", err)
+	}
+	const want = `{"mode":"lrwxrwxrwx","nlink":1,"owner":0,"group":0,"size":5,` +
+		`"modTime":"2024-05-01T03:00:00Z","name":"current","linkTarget":"data"}`
+	if got := string(data); got != want {
+		t.Errorf("Marshal: got %#q, want %#q", got, want)
+	}
+
+	var got Entry
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(e, got); diff != "" {
+		t.Errorf("Unmarshal (-want, +got):\n%s", diff)
+	}
+	if err := json.Unmarshal([]byte(`{"mode":420}`), &got); err == nil {
+		t.Error("Unmarshal numeric mode: got nil, want error")
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	mtime := time.Date(2019, 8, 26, 18, 30, 46, 0, time.Local).UTC()
+	tests := []struct {
+		input string
+		want  Entry
+	}{
+		{"-rw-r--r--  1 501    20      26628 2019-08-26 18:30:46 Documents/a.txt",
+			Entry{Mode: 0644, Nlink: 1, Owner: 501, Group: 20, Size: 26628, Name: "Documents/a.txt"}},
+		{"drwxr-xr-x  0 0      0           0 2019-08-26 18:30:46 Documents/",
+			Entry{Mode: os.ModeDir | 0755, Name: "Documents"}},
+		{"lrwxrwxrwx  0 501    20          0 2019-08-26 18:30:46 latest -> Documents/a.txt",
+			Entry{Mode: os.ModeSymlink | 0777, Owner: 501, Group: 20, Name: "latest", LinkTarget: "Documents/a.txt"}},
+		{"hrw-r--r--  2 501    20          0 2019-08-26 18:30:46 b.txt link to Documents/a.txt",
+			Entry{Mode: 0644, Nlink: 2, Owner: 501, Group: 20, Name: "b.txt", HardLinkTo: "Documents/a.txt"}},
+
+		{"crw-rw-rw-  1 0      0         1,3 2019-08-26 18:30:46 dev/null",
+			Entry{Mode: os.ModeDevice | os.ModeCharDevice | 0666, Nlink: 1, Name: "dev/null", DevMajor: 1, DevMinor: 3}},
+		{"brw-rw----  1 0      6        8,16 2019-08-26 18:30:46 dev/sdb",
+			Entry{Mode: os.ModeDevice | 0660, Nlink: 1, Group: 6, Name: "dev/sdb", DevMajor: 8, DevMinor: 16}},
+
+		// Separators in the names of other entries are not links.
+		{"-rw-r--r--  1 501    20          5 2019-08-26 18:30:46 a -> b link to c",
+			Entry{Mode: 0644, Nlink: 1, Owner: 501, Group: 20, Size: 5, Name: "a -> b link to c"}},
+	}
+	for _, test := range tests {
+		test.want.ModTime = mtime
+		got, err := parseEntry(test.input)
+		if err != nil {
+			t.Errorf("parseEntry(%q): unexpected error: %v", test.input, err)
+		} else if diff := cmp.Diff(&test.want, got); diff != "" {
+			t.Errorf("parseEntry(%q) (-want, +got):\n%s", test.input, diff)
+		}
+	}
+	const badDevice = "crw-rw-rw-  1 0      0         1,x 2019-08-26 18:30:46 dev/null"
+	if got, err := parseEntry(badDevice); err == nil {
+		t.Errorf("parseEntry(%q): got %v, want error", badDevice, got)
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	tests := []struct {
+		name, escaped string
+	}{
+		{"", ""},
+		{"plain/name.txt", "plain/name.txt"},
+		{`back\slash`, `back\\slash`},
+		{"tab\there\n", `tab\there\n`},
+		{"\x1b[0m", `\033[0m`},
+		{"caf\u00e9", `caf\303\251`},
+		{"\x7f\xff", `\177\377`},
+	}
+	for _, test := range tests {
+		if got := EscapeName(test.name); got != test.escaped {
+			t.Errorf("EscapeName(%q): got %q, want %q", test.name, got, test.escaped)
+		}
+		if got := unescapeName(test.escaped); got != test.name {
+			t.Errorf("unescapeName(%q): got %q, want %q", test.escaped, got, test.name)
+		}
+	}
+
+	// Malformed escapes are preserved.
+	for _, s := range []string{`\`, `a\q`, `\12`, `\19x`, `\400`} {
+		if got := unescapeName(s); got != s {
+			t.Errorf("unescapeName(%q): got %q, want unchanged", s, got)
+		}
+	}
+}
+
+func TestLiteralPattern(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"", ""},
+		{"a/b.txt", "a/b.txt"},
+		{"*.go", `\*.go`},
+		{`a?[b]\c`, `a\?\[b]\\c`},
+	}
+	for _, test := range tests {
+		if got := LiteralPattern(test.name); got != test.want {
+			t.Errorf("LiteralPattern(%q): got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	// Daily archives of "db" for 60 days, hourly archives of "logs" for the
+	// last 12 hours, and a partial "db" archive older than the latest.
+	var archs Archives
+	for i := 59; i >= 0; i-- {
+		when := now.Add(-time.Duration(i) * day)
+		name := "db." + when.Format("20060102")
+		archs = append(archs, Archive{Name: name, Base: "db", Tag: name[2:], Created: when})
+	}
+	for i := 11; i >= 0; i-- {
+		when := now.Add(-time.Duration(i) * time.Hour)
+		name := "logs." + when.Format("2006010215")
+		archs = append(archs, Archive{Name: name, Base: "logs", Tag: name[4:], Created: when})
+	}
+	archs = append(archs, Archive{
+		Name: "db.old.part", Base: "db", Tag: ".old.part", Created: now.Add(-day - time.Hour), Partial: true,
+	})
+	sort.Sort(archs)
+
+	names := func(as Archives) []string {
+		var out []string
+		for _, a := range as {
+			out = append(out, a.Name)
+		}
+		return out
+	}
+	keepNames := func(p Policy) []string {
+		keep, drop := p.Apply(archs, now)
+		if len(keep)+len(drop) != len(archs) {
+			t.Errorf("Apply: got %d kept + %d dropped, want %d", len(keep), len(drop), len(archs))
+		}
+		return names(keep)
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		if diff := cmp.Diff(names(archs), keepNames(Policy{})); diff != "" {
+			t.Errorf("Keep (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("GFS", func(t *testing.T) {
+		got := keepNames(Policy{
+			KeepLast: 1,
+			Daily:    3,
+			Weekly:   3,
+			Monthly:  3,
+			Overrides: map[string]Policy{
+				"logs": {Hourly: 2, MinAge: Duration(90 * time.Minute)},
+			},
+		})
+		want := []string{
+			"db.20240331", // monthly: March
+			"db.20240430", // monthly: April
+			"db.20240512", // weekly: week 19
+			"db.20240518", // daily
+			"db.20240519", // daily; weekly: week 20
+			"logs.2024052011",
+			"db.20240520",     // latest; daily, weekly, and monthly: May
+			"logs.2024052012", // latest
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Keep (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("MinAgeOnly", func(t *testing.T) {
+		// MinAge is not a rule by itself, so even when every archive is older
+		// than MinAge nothing is deleted.
+		keep, drop := Policy{MinAge: Duration(day)}.Apply(archs, now.Add(100*day))
+		if len(drop) != 0 {
+			t.Errorf("Apply: dropped %q, want none", names(drop))
+		}
+		if diff := cmp.Diff(names(archs), names(keep)); diff != "" {
+			t.Errorf("Keep (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("MinAge", func(t *testing.T) {
+		// MinAge protects young archives that the rules would delete.
+		got := keepNames(Policy{KeepLast: 1, MinAge: Duration(36 * time.Hour)})
+		want := []string{
+			"db.old.part", "db.20240519", "logs.2024052001", "logs.2024052002", "logs.2024052003",
+			"logs.2024052004", "logs.2024052005", "logs.2024052006", "logs.2024052007",
+			"logs.2024052008", "logs.2024052009", "logs.2024052010", "logs.2024052011",
+			"db.20240520", "logs.2024052012",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Keep (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("Partial", func(t *testing.T) {
+		// A partial archive newer than every complete one is retained.
+		archs := Archives{
+			{Name: "x.1", Base: "x", Created: now.Add(-2 * time.Hour)},
+			{Name: "x.2.part", Base: "x", Created: now.Add(-time.Hour), Partial: true},
+		}
+		keep, _ := Policy{KeepLast: 1}.Apply(archs, now)
+		if diff := cmp.Diff([]string{"x.1", "x.2.part"}, names(keep)); diff != "" {
+			t.Errorf("Keep (-want, +got):\n%s", diff)
+		}
+	})
+}
+
+func TestTemplate(t *testing.T) {
+	when := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		template string
+		fields   NameFields
+		name     string
+		parsed   time.Time // if non-zero, the parsed time differs from fields.Time
+	}{
+		{"{set}.{time}", NameFields{Set: "db", Time: when}, "db.20240501T030000", time.Time{}},
+		{"{host}/{set}.{time:2006-01-02T1504}", NameFields{Host: "venice", Set: "db", Time: when},
+			"venice/db.2024-05-01T0300", time.Time{}},
+		{"{set}-{kind}.{time:20060102}", NameFields{Set: "db", Kind: "hourly", Time: when},
+			"db-hourly.20240501", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"{kind}:{set}.{time:Jan02}", NameFields{Set: "my.files", Kind: "weekly", Time: when},
+			"weekly:my.files.May01", time.Date(0, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"static", NameFields{}, "static", time.Time{}},
+	}
+	for _, test := range tests {
+		tmpl, err := ParseTemplate(test.template)
+		if err != nil {
+			t.Fatalf("ParseTemplate(%q): unexpected error: %v", test.template, err)
+		}
+		name, err := tmpl.Format(test.fields)
+		if err != nil {
+			t.Errorf("Format %q: unexpected error: %v", test.template, err)
+		} else if name != test.name {
+			t.Errorf("Format %q: got %q, want %q", test.template, name, test.name)
+		}
+		got, ok := tmpl.Parse(test.name)
+		if !ok {
+			t.Errorf("Parse %q (%q): not matched", test.template, test.name)
+			continue
+		}
+		want := test.fields
+		if !test.parsed.IsZero() {
+			want.Time = test.parsed
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Parse %q (%q) (-want, +got):\n%s", test.template, test.name, diff)
+		}
+	}
+
+	tmpl := MustParseTemplate("{set}-{kind}.{time:20060102}")
+	for _, name := range []string{"", "db.20240501", "db-hourly.2024050", "db-hourly.20241301", "a/b-c.20240501"} {
+		if got, ok := tmpl.Parse(name); ok {
+			t.Errorf("Parse %q: got %+v, want no match", name, got)
+		}
+	}
+	for _, f := range []NameFields{
+		{Set: "db", Kind: "hourly"},                // missing time
+		{Set: "db", Time: when},                    // missing kind
+		{Set: "a/b", Kind: "hourly", Time: when},   // invalid set
+		{Set: "my-db", Kind: "hourly", Time: when}, // ambiguous
+	} {
+		if name, err := tmpl.Format(f); err == nil {
+			t.Errorf("Format %+v: got %q, want error", f, name)
+		}
+	}
+
+	// A value containing the separator after its placeholder is ambiguous.
+	if name, err := MustParseTemplate("{host}-{set}.{time}").Format(NameFields{
+		Host: "web-01", Set: "db", Time: when,
+	}); err == nil {
+		t.Errorf("Format with host web-01: got %q, want error", name)
+	}
+
+	for _, bad := range []string{
+		"", "{set", "{nonesuch}", "{set}{set}", "{host:x}", "{time:}",
+		"{set}{kind}.{time}",    // adjacent placeholders
+		"{host}/{kind}{set}",    // adjacent placeholders
+		"{set}.{time:2006-1-2}", // variable-width layout
+	} {
+		if _, err := ParseTemplate(bad); err == nil {
+			t.Errorf("ParseTemplate(%q): got nil, want error", bad)
+		}
+	}
+}
+
+func TestArchivesQuery(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	archs := Archives{
+		{Name: "db.1", Base: "db", Created: at(0)},
+		{Name: "web.1", Base: "web", Created: at(1)},
+		{Name: "db.2", Base: "db", Created: at(2)},
+		{Name: "db.3.part", Base: "db", Created: at(3), Partial: true},
+		{Name: "web.2", Base: "web", Created: at(4)},
+		{Name: "db.3", Base: "db", Created: at(6)},
+	}
+	names := func(as Archives) []string {
+		out := []string{}
+		for _, a := range as {
+			out = append(out, a.Name)
+		}
+		return out
+	}
+	check := func(what string, got Archives, want ...string) {
+		t.Helper()
+		if want == nil {
+			want = []string{}
+		}
+		if diff := cmp.Diff(want, names(got)); diff != "" {
+			t.Errorf("%s (-want, +got):\n%s", what, diff)
+		}
+	}
+
+	check("Before(2)", archs.Before(at(2)), "db.1", "web.1")
+	check("Before(0)", archs.Before(at(0)))
+	check("After(4)", archs.After(at(4)), "db.3")
+	check("After(6)", archs.After(at(6)))
+	check("Between(1, 4)", archs.Between(at(1), at(4)), "web.1", "db.2", "db.3.part")
+	check("Between(4, 1)", archs.Between(at(4), at(1)))
+	check("LatestN(db, 2)", archs.LatestN("db", 2), "db.2", "db.3")
+	check("LatestN(db, 5)", archs.LatestN("db", 5), "db.1", "db.2", "db.3")
+	check("LatestN(none, 1)", archs.LatestN("none", 1))
+
+	if diff := cmp.Diff([]string{"db", "web"}, archs.Bases()); diff != "" {
+		t.Errorf("Bases (-want, +got):\n%s", diff)
+	}
+	groups := archs.GroupByBase()
+	check("GroupByBase[db]", groups["db"], "db.1", "db.2", "db.3.part", "db.3")
+	check("GroupByBase[web]", groups["web"], "web.1", "web.2")
+
+	for _, test := range []struct {
+		base string
+		when time.Time
+		want string
+	}{
+		{"db", at(-5), "db.1"},
+		{"db", at(1), "db.1"}, // tie: the earlier wins
+		{"db", at(3), "db.2"}, // partial archives are skipped
+		{"db", at(5), "db.3"},
+		{"db", at(9), "db.3"},
+		{"web", at(2), "web.1"},
+		{"web", at(4), "web.2"},
+		{"none", at(0), ""},
+	} {
+		got, ok := archs.Nearest(test.base, test.when)
+		if ok != (test.want != "") || got.Name != test.want {
+			t.Errorf("Nearest(%q, %v): got %q, %v; want %q", test.base, test.when, got.Name, ok, test.want)
+		}
+	}
+	if got, ok := archs.LatestAsOf("db", at(5)); !ok || got.Name != "db.2" {
+		t.Errorf("LatestAsOf(db, 5): got %q, %v; want db.2", got.Name, ok)
+	}
+
+	m, err := archs.Match("db.[0-9]")
+	if err != nil {
+		t.Fatalf("Match: unexpected error: %v", err)
+	}
+	check("Match", m, "db.1", "db.2", "db.3")
+	if _, err := archs.Match("db.["); err == nil {
+		t.Error("Match: got nil, want error for malformed pattern")
+	}
+	check("MatchRegexp", archs.MatchRegexp(regexp.MustCompile(`\.part$|^web\.2`)), "db.3.part", "web.2")
+}
+
+func TestParsePlan(t *testing.T) {
+	p, err := ParsePlan([]byte(`{"sets": [
+	  {"name": "home", "archive": "{host}/{set}.{time}", "schedule": "daily",
+	   "create": {"include": ["a", "b"], "workDir": "/home/me", "diskPause": "1500ms"},
+	   "retain": {"daily": 7, "minAge": "36h"}},
+	  {"name": "db", "kind": "hourly", "create": {"include": ["db"]}}
+	]}`))
+	if err != nil {
+		t.Fatalf("ParsePlan: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(&Plan{Sets: []*BackupSet{{
+		Name:     "home",
+		Archive:  "{host}/{set}.{time}",
+		Create:   CreateOptions{Include: []string{"a", "b"}, WorkDir: "/home/me", DiskPause: Duration(1500 * time.Millisecond)},
+		Schedule: "daily",
+		Retain:   &Policy{Daily: 7, MinAge: Duration(36 * time.Hour)},
+	}, {
+		Name:   "db",
+		Kind:   "hourly",
+		Create: CreateOptions{Include: []string{"db"}},
+	}}}, p); diff != "" {
+		t.Errorf("ParsePlan (-want, +got):\n%s", diff)
+	}
+
+	// Durations are encoded as strings, and round-trip.
+	data, err := json.Marshal(p.Sets[0].Retain)
+	if err != nil {
+		t.Fatalf("Marshal policy: unexpected error: %v", err)
+	}
+	if got, want := string(data), `{"daily":7,"minAge":"36h0m0s"}`; got != want {
+		t.Errorf("Marshal policy: got %#q, want %#q", got, want)
+	}
+
+	for _, bad := range []string{
+		`{"sets": [{"name": "x", "create": {"include": ["a"]}, "bogus": true}]}`,
+		`{"sets": [{"create": {"include": ["a"]}}]}`,
+		`{"sets": [{"name": "x"}]}`,
+		`{"sets": [{"name": "x", "create": {"include": ["a"]}}, {"name": "x", "create": {"include": ["b"]}}]}`,
+		`{"sets": [{"name": "x", "archive": "{nonesuch}", "create": {"include": ["a"]}}]}`,
+		`{"sets": [{"name": "x", "archive": "backup.{time}", "create": {"include": ["a"]}}]}`,
+		`{"sets": [{"name": "x", "archive": "{set}", "create": {"include": ["a"]}}]}`,
+		`{"sets": [{"name": "x", "archive": "{set}{kind}.{time}", "create": {"include": ["a"]}}]}`,
+		`{"sets": [{"name": "x", "create": {"include": ["a"]}, "retain": {"minAge": 3600000000000}}]}`,
+		`{"sets": [{"name": "x", "create": {"include": ["a"]}, "retain": {"minAge": "1 hour"}}]}`,
+	} {
+		if _, err := ParsePlan([]byte(bad)); err == nil {
+			t.Errorf("ParsePlan(%#q): got nil, want error", bad)
+		}
+	}
+}
+
 func TestBasicRE(t *testing.T) {
 	tests := []struct {
 		in, want string
@@ -171,6 +960,21 @@ func TestRule(t *testing.T) {
 	}
 }
 
+func TestCacheTag(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("0123abcd", filepath.Join(dir, "cseq")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Config{
+		{CacheDir: dir},
+		{Flags: []Flag{{Flag: "cachedir", Value: dir}}},
+	} {
+		if tag, err := c.CacheTag(); err != nil || tag != "0123abcd" {
+			t.Errorf("CacheTag %+v: got %q, %v; want 0123abcd", c, tag, err)
+		}
+	}
+}
+
 func TestRC(t *testing.T) {
 	t.Skip("TODO: Fix dependency on ambient config")
 
@@ -0,0 +1,987 @@
+// Package tarsnaptest provides an in-process fake of the tarsnap command-line
+// tool, for testing code that uses the tarsnap package without a tarsnap
+// account.
+//
+// The fake stores each archive as a tar file in a local directory, and
+// understands the subset of tarsnap flags emitted by the tarsnap package.
+// Typical usage:
+//
+//	f := tarsnaptest.New(t.TempDir())
+//	cfg := f.Config()
+//	if err := cfg.Create("test", tarsnap.CreateOptions{...}); err != nil {
+//	   t.Fatalf("Create failed: %v", err)
+//	}
+package tarsnaptest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+)
+
+// Fake is an in-process simulation of the tarsnap command-line tool, which
+// stores archives as tar files in a local directory. It implements the
+// tarsnap.Runner interface, so it can be plugged into a tarsnap.Config.
+//
+// If a command specifies a --cachedir, the fake does not store a cache there,
+// but it maintains the "cseq" symlink that tarsnap replaces whenever the set
+// of archives changes, as read by tarsnap.Config.CacheTag.
+//
+// A Fake is safe for concurrent use by multiple goroutines.
+type Fake struct {
+	dir string
+
+	mu        sync.Mutex // serializes changes to the archive directory
+	outOfSync bool       // simulate a cache directory that needs --fsck
+}
+
+// New constructs a Fake that stores its archives in dir, which must exist and
+// should otherwise be empty.
+func New(dir string) *Fake { return &Fake{dir: dir} }
+
+// Dir returns the directory where f stores its archives.
+func (f *Fake) Dir() string { return f.dir }
+
+// SetCacheOutOfSync sets whether f simulates a cache directory that is out of
+// sync with the server. While this is true, operations other than --fsck,
+// --fsck-prune, and --initialize-cachedir fail as tarsnap does in that case.
+// A successful --fsck or --fsck-prune resets it to false.
+func (f *Fake) SetCacheOutOfSync(outOfSync bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outOfSync = outOfSync
+}
+
+// Config returns a new tarsnap.Config that runs its commands using f.
+func (f *Fake) Config() *tarsnap.Config { return &tarsnap.Config{Tool: "tarsnap", Runner: f} }
+
+// Run implements the tarsnap.Runner interface. It simulates the execution of
+// the tarsnap tool with the arguments of cmd, ignoring the tool name.
+func (f *Fake) Run(ctx context.Context, cmd *tarsnap.Command) error {
+	stdout, stderr := orDiscard(cmd.Stdout), orDiscard(cmd.Stderr)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	inv, err := parseArgs(cmd.Args)
+	if err == nil {
+		err = f.checkSync(inv)
+	}
+	if err == nil {
+		inv.log = stderr
+		inv.stdin = cmd.Stdin
+		switch inv.mode {
+		case "-c":
+			err = f.create(ctx, inv, stderr)
+		case "-x":
+			err = f.extract(ctx, inv, stdout)
+		case "-t":
+			err = f.listEntries(ctx, inv, stdout)
+		case "-r":
+			err = f.readTar(inv, stdout)
+		case "-d":
+			err = f.delete(inv)
+		case "--list-archives":
+			err = f.listArchives(inv, stdout)
+		case "--print-stats":
+			err = f.printStats(inv, stdout)
+		case "--fsck", "--fsck-prune":
+			f.SetCacheOutOfSync(false)
+		case "--recover", "--initialize-cachedir":
+			// nothing to do for the simulation
+		default:
+			err = errors.New("must specify one of -c, -d, -r, -t, -x, --list-archives, --print-stats, " +
+				"--fsck, --fsck-prune, --recover, --initialize-cachedir")
+		}
+	}
+	if inv != nil && inv.changesCache() {
+		if serr := f.updateCacheSeq(inv.cacheDir); err == nil {
+			err = serr
+		}
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	} else if err != nil {
+		fmt.Fprintf(stderr, "tarsnap: %v\n", err)
+		return exitError(1)
+	}
+	return nil
+}
+
+// checkSync reports an error if the cache is out of sync and inv requires it
+// to be in sync.
+func (f *Fake) checkSync(inv *invocation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch inv.mode {
+	case "--fsck", "--fsck-prune", "--initialize-cachedir":
+		return nil
+	}
+	if f.outOfSync {
+		return errors.New("Sequence number mismatch: Run --fsck")
+	}
+	return nil
+}
+
+// changesCache reports whether inv may change the set of archives, or the
+// contents of its cache directory. This is conservative, in that a failed
+// operation may still be reported as changing the cache.
+func (inv *invocation) changesCache() bool {
+	if inv.cacheDir == "" {
+		return false
+	}
+	switch inv.mode {
+	case "-c":
+		return !inv.dryRun
+	case "-d", "--fsck", "--fsck-prune", "--initialize-cachedir":
+		return true
+	}
+	return false
+}
+
+// updateCacheSeq replaces the "cseq" symlink in the cache directory dir with a
+// new random sequence number, as tarsnap does when the archive set changes.
+func (f *Fake) updateCacheSeq(dir string) error {
+	var seq [16]byte
+	rand.Read(seq[:])
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "cseq")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(hex.EncodeToString(seq[:]), path)
+}
+
+// exitError is the error reported when a simulated command fails.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+// ExitCode reports the exit status of the simulated command.
+func (e exitError) ExitCode() int { return int(e) }
+
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+// An invocation records the parsed arguments of a tarsnap command line.
+type invocation struct {
+	mode     string   // the operating mode, e.g., "-c"
+	archives []string // from -f, in order
+	dir      string   // from -C
+	cacheDir string   // from --cachedir
+
+	verbose      bool // -v
+	printStats   bool // --print-stats, --no-print-stats
+	dryRun       bool // --dry-run
+	followArgs   bool // -H
+	keepPaths    bool // -P
+	restorePerms bool // -p
+	fastRead     bool // --fast-read
+	resume       bool // --resume-extract
+	toStdout     bool // -O
+
+	created  time.Time       // --creationtime
+	rules    []*tarsnap.Rule // -s
+	exclude  []string        // --exclude
+	progress int64           // --progress-bytes
+	checkpt  int64           // --checkpoint-bytes
+	args     []string        // non-flag arguments
+
+	stdin io.Reader // the input for "@-"
+
+	// Progress reporting state.
+	log          io.Writer // where to write progress and verbose output
+	files, bytes int64     // files and bytes processed so far
+	nextReport   int64     // byte count at which to report progress
+}
+
+func (inv *invocation) setMode(mode string) error {
+	if inv.mode != "" && inv.mode != mode {
+		return fmt.Errorf("cannot specify both %s and %s", inv.mode, mode)
+	}
+	inv.mode = mode
+	return nil
+}
+
+// archive returns the single archive name required for the current mode.
+func (inv *invocation) archive() (string, error) {
+	if len(inv.archives) != 1 {
+		return "", fmt.Errorf("option %s requires exactly one archive name (-f)", inv.mode)
+	}
+	return inv.archives[0], nil
+}
+
+func parseArgs(args []string) (*invocation, error) {
+	inv := new(invocation)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			inv.args = args[i+1:]
+			break
+		} else if !strings.HasPrefix(arg, "-") {
+			inv.args = args[i:]
+			break
+		}
+
+		// Options that require a value.
+		switch arg {
+		case "-f", "-C", "-s", "--exclude", "--creationtime", "--progress-bytes",
+			"--checkpoint-bytes", "--keyfile", "--cachedir",
+			"--maxbw", "--maxbw-rate", "--maxbw-rate-up", "--maxbw-rate-down", "--disk-pause":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			if err := inv.setValue(arg, args[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var err error
+		switch arg {
+		case "-c", "-x", "-t", "-r", "-d", "--list-archives",
+			"--fsck", "--fsck-prune", "--recover", "--initialize-cachedir":
+			err = inv.setMode(arg)
+		case "-v":
+			inv.verbose = true
+		case "--print-stats":
+			inv.printStats = true
+		case "--no-print-stats":
+			inv.printStats = false
+		case "--dry-run":
+			inv.dryRun = true
+		case "-H":
+			inv.followArgs = true
+		case "-P":
+			inv.keepPaths = true
+		case "-p":
+			inv.restorePerms = true
+		case "--fast-read":
+			inv.fastRead = true
+		case "--resume-extract":
+			inv.resume = true
+		case "-O":
+			inv.toStdout = true
+		case "--quiet", "--no-humanize-numbers", "--humanize-numbers", "--iso-dates",
+			"--numeric-owner", "--store-atime", "--aggressive-networking", "-o":
+			// accepted, but no effect on the simulation
+		default:
+			err = fmt.Errorf("unrecognized option: %s", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if inv.mode == "" && inv.printStats {
+		inv.mode = "--print-stats"
+	}
+	return inv, nil
+}
+
+func (inv *invocation) setValue(flag, value string) error {
+	switch flag {
+	case "-f":
+		inv.archives = append(inv.archives, value)
+	case "-C":
+		inv.dir = value
+	case "--cachedir":
+		inv.cacheDir = value
+	case "-s":
+		r, err := tarsnap.ParseRule(value)
+		if err != nil {
+			return fmt.Errorf("invalid substitution %q: %v", value, err)
+		}
+		inv.rules = append(inv.rules, r)
+	case "--exclude":
+		inv.exclude = append(inv.exclude, value)
+	case "--creationtime":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid creation time %q", value)
+		}
+		inv.created = time.Unix(v, 0)
+	case "--progress-bytes":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid progress interval %q", value)
+		}
+		inv.progress = v
+	case "--checkpoint-bytes":
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v < 1000000 {
+			return fmt.Errorf("invalid checkpoint interval %q", value)
+		}
+		inv.checkpt = v
+	}
+	return nil
+}
+
+// processed records that the named entry of the given size was processed, and
+// writes verbose and progress output if requested.
+func (inv *invocation) processed(name string, size int64) {
+	if inv.verbose {
+		op := "x"
+		if inv.mode == "-c" {
+			op = "a"
+		}
+		fmt.Fprintf(inv.log, "%s %s\n", op, name)
+	}
+	inv.files++
+	inv.bytes += size
+	if inv.progress > 0 && inv.bytes >= inv.nextReport {
+		fmt.Fprintf(inv.log, "  Processed %d files, %d bytes\n", inv.files, inv.bytes)
+		inv.nextReport = (inv.bytes/inv.progress + 1) * inv.progress
+	}
+}
+
+// rename applies the substitution rules of inv to name.
+func (inv *invocation) rename(name string) string {
+	for _, r := range inv.rules {
+		name, _ = r.Apply(name)
+	}
+	return name
+}
+
+// excluded reports whether name matches any of the exclusion patterns.
+func (inv *invocation) excluded(name string) bool {
+	for _, pat := range inv.exclude {
+		if matchPath(pat, name, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the glob pattern matches name, in the manner of
+// bsdtar: The pattern may match any leading sequence of complete path
+// components of name.  If anchored is false, the match may also begin after
+// any "/" in the name.
+//
+// Unlike bsdtar, a "*" in the pattern does not match across a "/".
+func matchPath(pattern, name string, anchored bool) bool {
+	pattern = strings.Trim(pattern, "/")
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i := range parts {
+		if anchored && i > 0 {
+			break
+		}
+		for j := i + 1; j <= len(parts); j++ {
+			if ok, _ := path.Match(pattern, strings.Join(parts[i:j], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// archivePath returns the path of the file that stores the named archive.
+func (f *Fake) archivePath(name string) string {
+	return filepath.Join(f.dir, url.PathEscape(name)+".tar")
+}
+
+// readArchive returns the contents of the named archive.
+func (f *Fake) readArchive(name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := os.ReadFile(f.archivePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Archive does not exist: %s", name)
+	}
+	return data, err
+}
+
+// archiveInfo records the name, creation time, and contents size of an
+// archive stored by the fake.
+type archiveInfo struct {
+	name    string
+	created time.Time
+	size    int64
+}
+
+// archives returns the archives currently stored by f, ordered by name.
+func (f *Fake) archives() ([]archiveInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	des, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []archiveInfo
+	for _, de := range des {
+		base, ok := strings.CutSuffix(de.Name(), ".tar")
+		if !ok || de.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(base)
+		if err != nil {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, archiveInfo{name: name, created: fi.ModTime(), size: fi.Size()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+func (f *Fake) create(ctx context.Context, inv *invocation, stats io.Writer) error {
+	name, err := inv.archive()
+	if err != nil {
+		return err
+	}
+	if len(inv.args) == 0 {
+		return errors.New("no files or directories specified")
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, arg := range inv.args {
+		add := f.addPath
+		if arg == "@-" {
+			add = f.addStdin
+		} else if src, ok := strings.CutPrefix(arg, "@@"); ok {
+			add, arg = f.addArchive, src
+		}
+		if err := add(ctx, tw, inv, arg, inv.followArgs); err != nil {
+			// If checkpoints are enabled, an interrupted archive is stored as a
+			// partial archive containing what was written so far.
+			if ctx.Err() != nil && inv.checkpt > 0 && !inv.dryRun && tw.Close() == nil {
+				f.storeArchive(name+".part", buf.Bytes(), inv.created)
+			}
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if !inv.dryRun {
+		if err := f.storeArchive(name, buf.Bytes(), inv.created); err != nil {
+			return err
+		}
+	}
+	if inv.printStats {
+		size := int64(buf.Len())
+		return f.writeStats(stats, [][3]any{
+			{"This archive", size, compressedSize(buf.Bytes())},
+			{"New data", size, compressedSize(buf.Bytes())},
+		})
+	}
+	return nil
+}
+
+// storeArchive writes a new archive with the given name and contents.
+func (f *Fake) storeArchive(name string, data []byte, created time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	apath := f.archivePath(name)
+	if _, err := os.Stat(apath); err == nil {
+		return fmt.Errorf("An archive already exists with the name %q", name)
+	}
+	tmp := apath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if created.IsZero() {
+		created = time.Now()
+	}
+	if err := os.Chtimes(tmp, created, created); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, apath)
+}
+
+// addPath adds the file or directory at arg, relative to the working
+// directory, to the archive written by tw.
+func (f *Fake) addPath(ctx context.Context, tw *tar.Writer, inv *invocation, arg string, follow bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fpath := arg
+	if !filepath.IsAbs(fpath) && inv.dir != "" {
+		fpath = filepath.Join(inv.dir, fpath)
+	}
+	stat := os.Lstat
+	if follow {
+		stat = os.Stat
+	}
+	fi, err := stat(fpath)
+	if err != nil {
+		return err
+	}
+	name := filepath.ToSlash(filepath.Clean(arg))
+	if !inv.keepPaths {
+		name = strings.TrimLeft(name, "/")
+	}
+	if inv.excluded(name) {
+		return nil
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(fpath)
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = inv.rename(name)
+	if hdr.Name == "" {
+		return nil // the name was substituted away
+	}
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	inv.processed(hdr.Name, hdr.Size)
+
+	switch {
+	case fi.Mode().IsRegular():
+		in, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+
+	case fi.IsDir():
+		des, err := os.ReadDir(fpath)
+		if err != nil {
+			return err
+		}
+		for _, de := range des {
+			if err := f.addPath(ctx, tw, inv, path.Join(arg, de.Name()), false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addArchive adds the entries of the named archive to the archive written by
+// tw. The follow argument is ignored.
+func (f *Fake) addArchive(ctx context.Context, tw *tar.Writer, inv *invocation, name string, _ bool) error {
+	data, err := f.readArchive(name)
+	if err != nil {
+		return err
+	}
+	return addEntries(ctx, tw, inv, tar.NewReader(bytes.NewReader(data)))
+}
+
+// addStdin adds the entries of a tar stream read from the standard input to
+// the archive written by tw. The arguments other than tw and inv are ignored.
+func (f *Fake) addStdin(ctx context.Context, tw *tar.Writer, inv *invocation, _ string, _ bool) error {
+	if inv.stdin == nil {
+		return errors.New("no input for @-")
+	}
+	return addEntries(ctx, tw, inv, tar.NewReader(inv.stdin))
+}
+
+// addEntries copies the entries read from tr to tw, applying the exclusions
+// and substitutions of inv.
+func addEntries(ctx context.Context, tw *tar.Writer, inv *invocation, tr *tar.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name, isDir := strings.CutSuffix(hdr.Name, "/")
+		if inv.excluded(name) {
+			continue
+		}
+		hdr.Name = inv.rename(name)
+		if hdr.Name == "" {
+			continue
+		} else if isDir {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		} else if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+		inv.processed(hdr.Name, hdr.Size)
+	}
+}
+
+func (f *Fake) extract(ctx context.Context, inv *invocation, stdout io.Writer) error {
+	name, err := inv.archive()
+	if err != nil {
+		return err
+	}
+	data, err := f.readArchive(name)
+	if err != nil {
+		return err
+	}
+	m := newMatcher(inv.args, inv.fastRead)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for !m.done() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if inv.excluded(hdr.Name) || !m.match(hdr.Name) {
+			continue
+		}
+		if inv.toStdout {
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(stdout, tr); err != nil {
+					return err
+				}
+			}
+		} else if err := extractEntry(inv, hdr, tr); err != nil {
+			return err
+		}
+		inv.processed(hdr.Name, hdr.Size)
+	}
+	return m.check()
+}
+
+// extractEntry writes a single archive entry into the working directory.
+func extractEntry(inv *invocation, hdr *tar.Header, r io.Reader) error {
+	name := strings.TrimSuffix(hdr.Name, "/")
+	if !inv.keepPaths && !filepath.IsLocal(name) {
+		return fmt.Errorf("%s: Path contains '..'", hdr.Name)
+	}
+	target := filepath.Join(inv.dir, filepath.FromSlash(name))
+	mode := hdr.FileInfo().Mode()
+
+	if inv.resume && hdr.Typeflag == tar.TypeReg {
+		if fi, err := os.Stat(target); err == nil && fi.Size() == hdr.Size && fi.ModTime().Equal(hdr.ModTime) {
+			return nil // already extracted
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target) // replace an existing file, if any
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		return os.Link(filepath.Join(inv.dir, filepath.FromSlash(hdr.Linkname)), target)
+	default:
+		return nil // other types are not supported by the fake
+	}
+
+	if inv.restorePerms {
+		if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// A matcher selects archive entries by a list of inclusion patterns.
+type matcher struct {
+	patterns []string
+	matched  []bool
+	fastRead bool
+}
+
+func newMatcher(patterns []string, fastRead bool) *matcher {
+	return &matcher{patterns: patterns, matched: make([]bool, len(patterns)), fastRead: fastRead}
+}
+
+// match reports whether name is selected by m. An empty matcher selects all
+// names.
+func (m *matcher) match(name string) bool {
+	if len(m.patterns) == 0 {
+		return true
+	}
+	found := false
+	for i, pat := range m.patterns {
+		if m.fastRead && m.matched[i] {
+			continue
+		}
+		if matchPath(pat, name, true) {
+			m.matched[i] = true
+			found = true
+		}
+	}
+	return found
+}
+
+// done reports whether no further names can be selected by m.
+func (m *matcher) done() bool {
+	if !m.fastRead || len(m.patterns) == 0 {
+		return false
+	}
+	for _, ok := range m.matched {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// check reports an error if any of the patterns of m did not match.
+func (m *matcher) check() error {
+	var missing []string
+	for i, ok := range m.matched {
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s: Not found in archive", m.patterns[i]))
+		}
+	}
+	if len(missing) != 0 {
+		return errors.New(strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+func (f *Fake) listEntries(ctx context.Context, inv *invocation, w io.Writer) error {
+	name, err := inv.archive()
+	if err != nil {
+		return err
+	}
+	data, err := f.readArchive(name)
+	if err != nil {
+		return err
+	}
+	m := newMatcher(inv.args, inv.fastRead)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for !m.done() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if inv.excluded(hdr.Name) || !m.match(hdr.Name) {
+			continue
+		}
+		if !inv.verbose {
+			_, err = fmt.Fprintln(w, hdr.Name)
+		} else {
+			_, err = fmt.Fprintln(w, formatEntry(hdr))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return m.check()
+}
+
+// formatEntry formats hdr in the style of "tarsnap -tv --iso-dates --numeric-owner".
+func formatEntry(hdr *tar.Header) string {
+	var tail string
+	size := strconv.FormatInt(hdr.Size, 10)
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		tail = " -> " + tarsnap.EscapeName(hdr.Linkname)
+	case tar.TypeLink:
+		tail = " link to " + tarsnap.EscapeName(hdr.Linkname)
+	case tar.TypeChar, tar.TypeBlock:
+		size = fmt.Sprintf("%d,%d", hdr.Devmajor, hdr.Devminor) // as bsdtar lists devices
+	}
+	return fmt.Sprintf("%s  %d %-6d %-6d %10s %s %s%s",
+		formatMode(hdr), 0, hdr.Uid, hdr.Gid, size,
+		hdr.ModTime.In(time.Local).Format("2006-01-02 15:04:05"), tarsnap.EscapeName(hdr.Name), tail)
+}
+
+// formatMode formats the type and permission bits of hdr as "trwxrwxrwx".
+func formatMode(hdr *tar.Header) string {
+	var buf [10]byte
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		buf[0] = 'd'
+	case tar.TypeSymlink:
+		buf[0] = 'l'
+	case tar.TypeLink:
+		buf[0] = 'h'
+	case tar.TypeChar:
+		buf[0] = 'c'
+	case tar.TypeBlock:
+		buf[0] = 'b'
+	case tar.TypeFifo:
+		buf[0] = 'p'
+	default:
+		buf[0] = '-'
+	}
+	const rwx = "rwxrwxrwx"
+	for i := range 9 {
+		if hdr.Mode&(1<<(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		} else {
+			buf[i+1] = '-'
+		}
+	}
+	special := func(pos int, bit int64, set, unset byte) {
+		if hdr.Mode&bit != 0 {
+			if buf[pos] == 'x' {
+				buf[pos] = set
+			} else {
+				buf[pos] = unset
+			}
+		}
+	}
+	special(3, 04000, 's', 'S')
+	special(6, 02000, 's', 'S')
+	special(9, 01000, 't', 'T')
+	return string(buf[:])
+}
+
+func (f *Fake) readTar(inv *invocation, w io.Writer) error {
+	name, err := inv.archive()
+	if err != nil {
+		return err
+	}
+	data, err := f.readArchive(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (f *Fake) delete(inv *invocation) error {
+	if len(inv.archives) == 0 {
+		return errors.New("option -d requires an archive name (-f)")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range inv.archives {
+		err := os.Remove(f.archivePath(name))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Archive does not exist: %s", name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fake) listArchives(inv *invocation, w io.Writer) error {
+	archs, err := f.archives()
+	if err != nil {
+		return err
+	}
+	for _, a := range archs {
+		if inv.verbose {
+			fmt.Fprintf(w, "%s\t%s\n", a.name, a.created.In(time.Local).Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Fprintln(w, a.name)
+		}
+	}
+	return nil
+}
+
+func (f *Fake) printStats(inv *invocation, w io.Writer) error {
+	var rows [][3]any
+	for _, name := range inv.archives {
+		data, err := f.readArchive(name)
+		if err != nil {
+			return err
+		}
+		size, csize := int64(len(data)), compressedSize(data)
+		rows = append(rows, [3]any{name, size, csize}, [3]any{"  (unique data)", size, csize})
+	}
+	return f.writeStats(w, rows)
+}
+
+// writeStats writes a table of storage statistics in the format of tarsnap
+// --print-stats, beginning with the totals for all archives and followed by
+// the specified rows.
+func (f *Fake) writeStats(w io.Writer, rows [][3]any) error {
+	archs, err := f.archives()
+	if err != nil {
+		return err
+	}
+	var total, ctotal int64
+	for _, a := range archs {
+		data, err := f.readArchive(a.name)
+		if err != nil {
+			return err
+		}
+		total += int64(len(data))
+		ctotal += compressedSize(data)
+	}
+	rows = append([][3]any{
+		{"All archives", total, ctotal},
+		{"  (unique data)", total, ctotal},
+	}, rows...)
+
+	fmt.Fprintf(w, "%-32s %15s %15s\n", "", "Total size", "Compressed size")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-32s %15d %15d\n", row[0], row[1], row[2])
+	}
+	return nil
+}
+
+// compressedSize reports the size of data after gzip compression.
+func compressedSize(data []byte) int64 {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return int64(buf.Len())
+}
@@ -0,0 +1,1029 @@
+package tarsnaptest_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/creachadair/tarsnap"
+	"github.com/creachadair/tarsnap/tarsnaptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeTree creates files under dir with the given names and contents.
+// Names ending in "/" denote directories.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, text := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(path, 0700); err != nil {
+				t.Fatalf("Creating directory: %v", err)
+			}
+			continue
+		} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("Creating directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatalf("Writing file: %v", err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"data/a.txt":        "apple\n",
+		"data/b.txt":        "banana\n",
+		"data/sub/c.txt":    "cherry\n",
+		"data/sub/c.txt~":   "backup\n",
+		"data/.git/config":  "ignored\n",
+		"data/empty/":       "",
+		"other/ignored.txt": "not included\n",
+	})
+
+	const testArchive = "test-archive.1"
+	ts := time.Date(1996, 6, 9, 11, 37, 0, 0, time.UTC)
+	if err := cfg.Create(testArchive, tarsnap.CreateOptions{
+		Include:      []string{"data"},
+		Exclude:      []string{".git", "*~"},
+		WorkDir:      src,
+		CreationTime: ts,
+	}); err != nil {
+		t.Fatalf("Create %s failed: %v", testArchive, err)
+	}
+
+	// Creating a duplicate archive should fail.
+	if err := cfg.Create(testArchive, tarsnap.CreateOptions{
+		Include: []string{"data"},
+		WorkDir: src,
+	}); !errors.Is(err, tarsnap.ErrArchiveExists) {
+		t.Errorf("Create duplicate: got error %v, want %v", err, tarsnap.ErrArchiveExists)
+	}
+
+	// A dry run should not create an archive.
+	if err := cfg.Create("dry-run", tarsnap.CreateOptions{
+		Include: []string{"other"},
+		WorkDir: src,
+		DryRun:  true,
+	}); err != nil {
+		t.Errorf("Create dry run failed: %v", err)
+	}
+
+	lst, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if diff := cmp.Diff(tarsnap.Archives{{
+		Name:    testArchive,
+		Base:    "test-archive",
+		Tag:     ".1",
+		Created: ts,
+	}}, lst); diff != "" {
+		t.Errorf("List (-want, +got):\n%s", diff)
+	}
+
+	var names []string
+	if err := cfg.Entries(testArchive, func(e *tarsnap.Entry) error {
+		names = append(names, e.Name)
+		if e.Name == "data/a.txt" && (e.Size != 6 || !e.Mode.IsRegular()) {
+			t.Errorf("Entry %q: got size %d mode %v, want 6, regular", e.Name, e.Size, e.Mode)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff([]string{
+		"data", "data/a.txt", "data/b.txt", "data/empty", "data/sub", "data/sub/c.txt",
+	}, names); diff != "" {
+		t.Errorf("Entries (-want, +got):\n%s", diff)
+	}
+
+	if err := cfg.Entries("no-such-archive", func(*tarsnap.Entry) error {
+		return nil
+	}); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("Entries: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+
+	dst := t.TempDir()
+	if err := cfg.Extract(testArchive, tarsnap.ExtractOptions{
+		Include: []string{"data/sub"},
+		WorkDir: dst,
+	}); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "data/sub/c.txt")); err != nil {
+		t.Errorf("Reading extracted file: %v", err)
+	} else if string(got) != "cherry\n" {
+		t.Errorf("Extracted file: got %q, want %q", got, "cherry\n")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "data/a.txt")); err == nil {
+		t.Error("Extract included a file not selected")
+	}
+
+	si, err := cfg.Size(testArchive)
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	} else if si.All == nil || si.Archive[testArchive] == nil {
+		t.Errorf("Size: missing results: %+v", si)
+	} else if si.All.InputBytes != si.Archive[testArchive].InputBytes {
+		t.Errorf("Size: total %d != archive %d", si.All.InputBytes, si.Archive[testArchive].InputBytes)
+	}
+
+	if err := cfg.Delete(testArchive); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err := cfg.Delete(testArchive); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("Delete: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+	if lst, err := cfg.List(); err != nil {
+		t.Errorf("List failed: %v", err)
+	} else if len(lst) != 0 {
+		t.Errorf("List after delete: got %+v, want empty", lst)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt": strings.Repeat("a", 1000),
+		"b.txt": strings.Repeat("b", 1000),
+		"c.txt": strings.Repeat("c", 1000),
+	})
+
+	var creates []tarsnap.Progress
+	if err := cfg.Create("test", tarsnap.CreateOptions{
+		Include:       []string{"a.txt", "b.txt", "c.txt"},
+		WorkDir:       src,
+		Progress:      func(p tarsnap.Progress) { creates = append(creates, p) },
+		ProgressBytes: 1500,
+	}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(creates) == 0 {
+		t.Fatal("Create: no progress was reported")
+	}
+	last := creates[len(creates)-1]
+	if last.Files != 3 || last.Bytes != 3000 || last.Path != "c.txt" {
+		t.Errorf("Create: final progress is %+v, want 3 files, 3000 bytes, path c.txt", last)
+	}
+
+	var paths []string
+	if err := cfg.Extract("test", tarsnap.ExtractOptions{
+		Include:  []string{"b.txt"},
+		WorkDir:  t.TempDir(),
+		Progress: func(p tarsnap.Progress) { paths = append(paths, p.Path) },
+	}); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"b.txt", "b.txt"}, paths); diff != "" {
+		t.Errorf("Extract progress paths (-want, +got):\n%s", diff)
+	}
+}
+
+func TestCreateStats(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": strings.Repeat("a", 5000)})
+
+	res, err := cfg.CreateStats("test", tarsnap.CreateOptions{
+		Include: []string{"a.txt"},
+		WorkDir: src,
+	})
+	if err != nil {
+		t.Fatalf("CreateStats failed: %v", err)
+	}
+	if res.Archive.InputBytes < 5000 || res.Archive.UniqueBytes == 0 {
+		t.Errorf("Archive sizes: got %v, want at least 5000 input bytes", res.Archive)
+	}
+	if res.All.InputBytes != res.Archive.InputBytes {
+		t.Errorf("All sizes: got %v, want %d input bytes", res.All, res.Archive.InputBytes)
+	}
+}
+
+func TestCreateStatsProgress(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+
+	// The verbose line for a name ending in two numbers looks like a line of
+	// statistics, and must still be reported as progress.
+	writeTree(t, src, map[string]string{"report 2024 05": "data\n", "b": "more data\n"})
+
+	var paths []string
+	res, err := cfg.CreateStats("test", tarsnap.CreateOptions{
+		Include:  []string{"report 2024 05", "b"},
+		WorkDir:  src,
+		Progress: func(p tarsnap.Progress) { paths = append(paths, p.Path) },
+	})
+	if err != nil {
+		t.Fatalf("CreateStats failed: %v", err)
+	}
+	if !slices.Contains(paths, "report 2024 05") || !slices.Contains(paths, "b") {
+		t.Errorf("Progress paths: got %q, want both files", paths)
+	}
+	if res.Archive.InputBytes == 0 {
+		t.Errorf("Archive sizes: got %v, want non-zero input bytes", res.Archive)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	f := tarsnaptest.New(t.TempDir())
+	cfg := f.Config()
+
+	f.SetCacheOutOfSync(true)
+	if _, err := cfg.List(); !errors.Is(err, tarsnap.ErrCacheOutOfSync) {
+		t.Fatalf("List: got error %v, want %v", err, tarsnap.ErrCacheOutOfSync)
+	}
+	if err := cfg.Fsck(); err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if _, err := cfg.List(); err != nil {
+		t.Errorf("List after Fsck failed: %v", err)
+	}
+	for _, op := range []func() error{cfg.FsckPrune, cfg.Recover, cfg.InitializeCacheDir} {
+		if err := op(); err != nil {
+			t.Errorf("Operation failed: %v", err)
+		}
+	}
+}
+
+func TestPartial(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "apple\n", "b.txt": "banana\n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create a complete archive, then interrupt the creation of a newer one
+	// after its first file is processed.
+	opts := tarsnap.CreateOptions{
+		Include:         []string{"a.txt", "b.txt"},
+		WorkDir:         src,
+		CheckpointBytes: tarsnap.MinCheckpointBytes,
+		CreationTime:    time.Now().Add(-time.Hour),
+	}
+	if err := cfg.CreateContext(ctx, "db.1", opts); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	opts.CreationTime = time.Now().Add(-time.Minute)
+	opts.Progress = func(tarsnap.Progress) { cancel() }
+	if err := cfg.CreateContext(ctx, "db.2", opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Create: got error %v, want %v", err, context.Canceled)
+	}
+
+	lst, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var got []string
+	for _, a := range lst {
+		got = append(got, fmt.Sprintf("%s:%v", a.Name, a.Partial))
+	}
+	if diff := cmp.Diff([]string{"db.1:false", "db.2.part:true"}, got); diff != "" {
+		t.Errorf("List (-want, +got):\n%s", diff)
+	}
+	if latest, ok := lst.Latest("db"); !ok || latest.Name != "db.1" {
+		t.Errorf("Latest: got %+v, %v; want db.1", latest, ok)
+	}
+
+	opts.CheckpointBytes = 1000
+	if err := cfg.Create("db.3", opts); err == nil {
+		t.Error("Create with a small checkpoint interval succeeded unexpectedly")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"one/a.txt":  "apple\n",
+		"one/a.txt~": "old apple\n",
+		"two/b.txt":  "banana\n",
+	})
+	created := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	for _, dir := range []string{"one", "two"} {
+		if err := cfg.Create(dir, tarsnap.CreateOptions{
+			Include:      []string{dir},
+			WorkDir:      src,
+			CreationTime: created,
+		}); err != nil {
+			t.Fatalf("Create %s failed: %v", dir, err)
+		}
+	}
+
+	entries := func(name string) []string {
+		t.Helper()
+		var names []string
+		if err := cfg.Entries(name, func(e *tarsnap.Entry) error {
+			names = append(names, e.Name)
+			return nil
+		}); err != nil {
+			t.Fatalf("Entries %s failed: %v", name, err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err := cfg.Copy("copy", "one", tarsnap.CopyOptions{
+		Modify:  []string{"/^one/uno/"},
+		Exclude: []string{"*~"},
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"uno", "uno/a.txt"}, entries("copy")); diff != "" {
+		t.Errorf("Copy entries (-want, +got):\n%s", diff)
+	}
+
+	if err := cfg.Merge("merged", []string{"one", "two"}, tarsnap.CopyOptions{}); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"one", "one/a.txt", "one/a.txt~", "two", "two/b.txt"},
+		entries("merged")); diff != "" {
+		t.Errorf("Merge entries (-want, +got):\n%s", diff)
+	}
+
+	if err := cfg.Rename("two", "deux"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := cfg.Rename("two", "zwei"); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("Rename: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+	lst, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var names []string
+	for _, a := range lst {
+		names = append(names, a.Name)
+		if a.Name == "deux" && !a.Created.Equal(created) {
+			t.Errorf("Renamed archive created %v, want %v", a.Created, created)
+		}
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff([]string{"copy", "deux", "merged", "one"}, names); diff != "" {
+		t.Errorf("List (-want, +got):\n%s", diff)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"etc/app.conf": "setting = true\n",
+		"etc/big.dat":  strings.Repeat("0123456789", 100000),
+	})
+	if err := cfg.Create("test", tarsnap.CreateOptions{Include: []string{"etc"}, WorkDir: src}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	rc, err := cfg.Open("test", "etc/app.conf")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Errorf("Reading file: %v", err)
+	} else if got, want := string(data), "setting = true\n"; got != want {
+		t.Errorf("Contents: got %q, want %q", got, want)
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	// Closing early should not block.
+	rc, err = cfg.Open("test", "etc/big.dat")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		t.Errorf("Reading file: %v", err)
+	} else if got := string(buf); got != "0123456789" {
+		t.Errorf("Contents: got %q, want %q", got, "0123456789")
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	// A missing file is reported by Read.
+	rc, err = cfg.Open("test", "etc/nonesuch")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer rc.Close()
+	if data, err := io.ReadAll(rc); err == nil {
+		t.Errorf("Reading missing file: got %q, want error", data)
+	}
+}
+
+func TestCreateFromTar(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range []struct{ name, text string }{
+		{"dump/db.sql", "CREATE TABLE t (x int);\n"},
+		{"dump/db.sql~", "stale\n"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.text)),
+			ModTime:  time.Now(),
+		}); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+		io.WriteString(tw, file.text)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+
+	if err := cfg.CreateFromTar("dump", &buf, tarsnap.CreateOptions{
+		Exclude: []string{"*~"},
+	}); err != nil {
+		t.Fatalf("CreateFromTar failed: %v", err)
+	}
+
+	rc, err := cfg.Open("dump", "dump/db.sql")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer rc.Close()
+	if data, err := io.ReadAll(rc); err != nil {
+		t.Errorf("Reading file: %v", err)
+	} else if got, want := string(data), "CREATE TABLE t (x int);\n"; got != want {
+		t.Errorf("Contents: got %q, want %q", got, want)
+	}
+
+	var names []string
+	if err := cfg.Entries("dump", func(e *tarsnap.Entry) error {
+		names = append(names, e.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"dump/db.sql"}, names); diff != "" {
+		t.Errorf("Entries (-want, +got):\n%s", diff)
+	}
+
+	// An include list is rejected, rather than silently ignored.
+	if err := cfg.CreateFromTar("dump2", strings.NewReader(""), tarsnap.CreateOptions{
+		Include: []string{"dump/db.sql"},
+	}); err == nil {
+		t.Error("CreateFromTar with Include: got nil, want error")
+	}
+	if lst, err := cfg.List(); err != nil {
+		t.Fatalf("List failed: %v", err)
+	} else if len(lst) != 1 {
+		t.Errorf("List: got %d archives, want 1", len(lst))
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	files := map[string]string{"a.txt": "apple\n", "b.txt": "banana\n"}
+	writeTree(t, src, files)
+	if err := cfg.Create("test", tarsnap.CreateOptions{Include: []string{"a.txt", "b.txt"}, WorkDir: src}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	rc, err := cfg.ReadTar("test")
+	if err != nil {
+		t.Fatalf("ReadTar failed: %v", err)
+	}
+	defer rc.Close()
+	got := make(map[string]string)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Reading tar stream: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Reading %s: %v", hdr.Name, err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	if diff := cmp.Diff(files, got); diff != "" {
+		t.Errorf("Tar contents (-want, +got):\n%s", diff)
+	}
+
+	rc, err = cfg.ReadTar("nonesuch")
+	if err != nil {
+		t.Fatalf("ReadTar failed: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("Reading missing archive: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+}
+
+func TestFS(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"site/index.html":     "<h1>hello</h1>\n",
+		"site/css/style.css":  "h1 { color: red }\n",
+		"site/img/":           "",
+		"site/docs/a/b/c.txt": "deep\n",
+	})
+	if err := cfg.Create("site", tarsnap.CreateOptions{Include: []string{"site"}, WorkDir: src}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	afs, err := cfg.FS("site")
+	if err != nil {
+		t.Fatalf("FS failed: %v", err)
+	}
+	if err := fstest.TestFS(afs, "site/index.html", "site/css/style.css", "site/docs/a/b/c.txt", "site/img"); err != nil {
+		t.Errorf("TestFS: %v", err)
+	}
+
+	if data, err := fs.ReadFile(afs, "site/docs/a/b/c.txt"); err != nil {
+		t.Errorf("ReadFile failed: %v", err)
+	} else if got := string(data); got != "deep\n" {
+		t.Errorf("ReadFile: got %q, want %q", got, "deep\n")
+	}
+	if _, err := afs.Stat("site/nonesuch"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: got error %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if _, err := cfg.FS("nonesuch"); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("FS: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"d/same.txt":    "unchanged\n",
+		"d/grow.txt":    "short\n",
+		"d/removed.txt": "going away\n",
+		"d/chmod.txt":   "permissions\n",
+	})
+	opts := tarsnap.CreateOptions{Include: []string{"d"}, WorkDir: src}
+	if err := cfg.Create("before", opts); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	writeTree(t, src, map[string]string{
+		"d/grow.txt":  "much longer than before\n",
+		"d/added.txt": "new\n",
+	})
+	if err := os.Remove(filepath.Join(src, "d/removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "d/chmod.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Create("after", opts); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	d, err := cfg.Diff("before", "after")
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	type change struct {
+		Kind tarsnap.ChangeKind
+		Name string
+		Mode bool // whether the mode changed
+		Size bool // whether the size changed
+	}
+	var got []change
+	for _, c := range d.Changes {
+		if c.Name == "d" {
+			continue // the directory mtime may or may not have changed
+		}
+		got = append(got, change{c.Kind, c.Name, c.Fields&tarsnap.FieldMode != 0, c.Fields&tarsnap.FieldSize != 0})
+	}
+	if diff := cmp.Diff([]change{
+		{tarsnap.Added, "d/added.txt", false, false},
+		{tarsnap.Modified, "d/chmod.txt", true, false},
+		{tarsnap.Modified, "d/grow.txt", false, true},
+		{tarsnap.Removed, "d/removed.txt", false, false},
+	}, got); diff != "" {
+		t.Errorf("Diff changes (-want, +got):\n%s", diff)
+	}
+
+	text := d.String()
+	for _, want := range []string{"--- before\n+++ after\n", `+-rw`, `"d/added.txt"`, `-` + d.Changes[len(d.Changes)-1].Old.String()} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Diff text is missing %q:\n%s", want, text)
+		}
+	}
+
+	if _, err := cfg.Diff("before", "nonesuch"); !errors.Is(err, tarsnap.ErrArchiveNotFound) {
+		t.Errorf("Diff: got error %v, want %v", err, tarsnap.ErrArchiveNotFound)
+	}
+}
+
+func TestSpecialEntries(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Devmajor: 8},
+		{Typeflag: tar.TypeFifo, Name: "run/pipe", Mode: 0600},
+	} {
+		hdr.ModTime = time.Now()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+	}
+	tw.Close()
+	if err := cfg.CreateFromTar("system", &buf, tarsnap.CreateOptions{}); err != nil {
+		t.Fatalf("CreateFromTar failed: %v", err)
+	}
+
+	got := make(map[string]os.FileMode)
+	devs := make(map[string][2]int64)
+	if err := cfg.Entries("system", func(e *tarsnap.Entry) error {
+		got[e.Name] = e.Mode
+		if e.Mode&os.ModeDevice != 0 {
+			devs[e.Name] = [2]int64{e.DevMajor, e.DevMinor}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if diff := cmp.Diff(map[string]os.FileMode{
+		"tmp":      os.ModeDir | os.ModeSticky | 0777,
+		"dev/null": os.ModeDevice | os.ModeCharDevice | 0666,
+		"dev/sda":  os.ModeDevice | 0660,
+		"run/pipe": os.ModeNamedPipe | 0600,
+	}, got); diff != "" {
+		t.Errorf("Entry modes (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][2]int64{
+		"dev/null": {1, 3},
+		"dev/sda":  {8, 0},
+	}, devs); diff != "" {
+		t.Errorf("Device numbers (-want, +got):\n%s", diff)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+
+	now := time.Now().Truncate(time.Second)
+	create := func(name, target string) {
+		t.Helper()
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "data.txt", Mode: 0644, Size: 6, ModTime: now})
+		tw.Write([]byte("hello\n"))
+		for _, hdr := range []*tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "current", Linkname: target, Mode: 0777},
+			{Typeflag: tar.TypeLink, Name: "copy.txt", Linkname: "data.txt", Mode: 0644},
+		} {
+			hdr.ModTime = now
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("WriteHeader: %v", err)
+			}
+		}
+		tw.Close()
+		if err := cfg.CreateFromTar(name, &buf, tarsnap.CreateOptions{}); err != nil {
+			t.Fatalf("CreateFromTar failed: %v", err)
+		}
+	}
+	create("v1", "data.txt")
+	create("v2", "other.txt")
+
+	type link struct{ Name, Symlink, Hardlink string }
+	var got []link
+	if err := cfg.Entries("v1", func(e *tarsnap.Entry) error {
+		got = append(got, link{e.Name, e.LinkTarget, e.HardLinkTo})
+		return nil
+	}); err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if diff := cmp.Diff([]link{
+		{Name: "data.txt"},
+		{Name: "current", Symlink: "data.txt"},
+		{Name: "copy.txt", Hardlink: "data.txt"},
+	}, got); diff != "" {
+		t.Errorf("Entries (-want, +got):\n%s", diff)
+	}
+
+	// A hard link reads as the contents of its target.
+	afs, err := cfg.FS("v1")
+	if err != nil {
+		t.Fatalf("FS failed: %v", err)
+	}
+	if data, err := fs.ReadFile(afs, "copy.txt"); err != nil {
+		t.Errorf("ReadFile failed: %v", err)
+	} else if got := string(data); got != "hello\n" {
+		t.Errorf("ReadFile: got %q, want %q", got, "hello\n")
+	}
+
+	// Changing the target of a link is a modification, not a rename.
+	d, err := cfg.Diff("v1", "v2")
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(d.Changes) != 1 {
+		t.Fatalf("Diff: got %d changes, want 1:\n%v", len(d.Changes), d)
+	}
+	if c := d.Changes[0]; c.Kind != tarsnap.Modified || c.Name != "current" || c.Fields != tarsnap.FieldLink {
+		t.Errorf("Diff: got %v %q fields=%v, want modified %q fields=link", c.Kind, c.Name, c.Fields, "current")
+	}
+}
+
+func TestEscapedNames(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+
+	files := []struct{ name, data string }{
+		{"tab\there", "tab\n"},
+		{"caf\u00e9", "coffee\n"},
+		{"starry.txt", "sky\n"},
+		{"star*.txt", "star\n"},
+	}
+	var buf bytes.Buffer
+	var want []string
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: time.Now(),
+		})
+		tw.Write([]byte(f.data))
+		want = append(want, f.name)
+	}
+	tw.Close()
+	if err := cfg.CreateFromTar("names", &buf, tarsnap.CreateOptions{}); err != nil {
+		t.Fatalf("CreateFromTar failed: %v", err)
+	}
+
+	var got []string
+	if err := cfg.Entries("names", func(e *tarsnap.Entry) error {
+		got = append(got, e.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("Entries failed: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Entry names (-want, +got):\n%s", diff)
+	}
+
+	// Names from the listing can be used to read the files, and wildcards in
+	// them are matched literally.
+	afs, err := cfg.FS("names")
+	if err != nil {
+		t.Fatalf("FS failed: %v", err)
+	}
+	for _, f := range files {
+		if data, err := fs.ReadFile(afs, f.name); err != nil {
+			t.Errorf("ReadFile %q failed: %v", f.name, err)
+		} else if string(data) != f.data {
+			t.Errorf("ReadFile %q: got %q, want %q", f.name, data, f.data)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "apple\n"})
+
+	now := time.Now().Truncate(time.Second)
+	for i, name := range []string{"db.1", "db.2", "db.3", "web.1"} {
+		if err := cfg.Create(name, tarsnap.CreateOptions{
+			Include:      []string{"a.txt"},
+			WorkDir:      src,
+			CreationTime: now.Add(time.Duration(i-10) * time.Hour),
+		}); err != nil {
+			t.Fatalf("Create %q failed: %v", name, err)
+		}
+	}
+	listNames := func() []string {
+		t.Helper()
+		lst, err := cfg.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		var out []string
+		for _, a := range lst {
+			out = append(out, a.Name)
+		}
+		return out
+	}
+	names := func(as tarsnap.Archives) []string {
+		var out []string
+		for _, a := range as {
+			out = append(out, a.Name)
+		}
+		return out
+	}
+
+	policy := tarsnap.Policy{KeepLast: 1}
+	rep, err := cfg.Prune(policy, true)
+	if err != nil {
+		t.Fatalf("Prune (dry run) failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"db.1", "db.2"}, names(rep.Delete)); diff != "" {
+		t.Errorf("Prune delete (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"db.1", "db.2", "db.3", "web.1"}, listNames()); diff != "" {
+		t.Errorf("Dry run deleted archives (-want, +got):\n%s", diff)
+	}
+
+	if _, err := cfg.Prune(policy, false); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"db.3", "web.1"}, listNames()); diff != "" {
+		t.Errorf("List after Prune (-want, +got):\n%s", diff)
+	}
+}
+
+func TestCreateNamed(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	cfg.Naming = tarsnap.MustParseTemplate("{host}/{set}-{kind}.{time:2006-01-02T1504}")
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "apple\n"})
+
+	when := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	name, err := cfg.CreateNamed(tarsnap.NameFields{
+		Host: "venice", Set: "db", Kind: "hourly", Time: when,
+	}, tarsnap.CreateOptions{Include: []string{"a.txt"}, WorkDir: src})
+	if err != nil {
+		t.Fatalf("CreateNamed failed: %v", err)
+	}
+	if want := "venice/db-hourly.2024-05-01T0300"; name != want {
+		t.Errorf("CreateNamed: got name %q, want %q", name, want)
+	}
+	if err := cfg.Create("unrelated", tarsnap.CreateOptions{Include: []string{"a.txt"}, WorkDir: src}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	lst, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	got := make(map[string]*tarsnap.NameFields)
+	for _, a := range lst {
+		got[a.Name] = a.Fields
+	}
+	if diff := cmp.Diff(map[string]*tarsnap.NameFields{
+		name:        {Host: "venice", Set: "db", Kind: "hourly", Time: when},
+		"unrelated": nil,
+	}, got); diff != "" {
+		t.Errorf("List fields (-want, +got):\n%s", diff)
+	}
+
+	// The creation time of the archive matches its name.
+	if a, ok := lst.LatestAsOf("venice/db-hourly", when); !ok || !a.Created.Equal(when) {
+		t.Errorf("LatestAsOf: got %+v, %v; want created at %v", a, ok, when)
+	}
+}
+
+func TestListCache(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	cacheDir := t.TempDir()
+	cfg.CacheDir = cacheDir
+	cfg.ListCache = filepath.Join(t.TempDir(), "list.json")
+
+	var lists int
+	cfg.CmdLog = func(_ string, args []string) {
+		if slices.Contains(args, "--list-archives") {
+			lists++
+		}
+	}
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "apple\n"})
+	create := func(name string) {
+		t.Helper()
+		if err := cfg.Create(name, tarsnap.CreateOptions{Include: []string{"a.txt"}, WorkDir: src}); err != nil {
+			t.Fatalf("Create %q failed: %v", name, err)
+		}
+	}
+	checkList := func(wantLists int, want ...string) {
+		t.Helper()
+		lst, err := cfg.List()
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		var got []string
+		for _, a := range lst {
+			got = append(got, a.Name)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("List (-want, +got):\n%s", diff)
+		}
+		if lists != wantLists {
+			t.Errorf("List: tarsnap listed archives %d times, want %d", lists, wantLists)
+		}
+	}
+
+	create("a")
+	tag, err := cfg.CacheTag()
+	if err != nil || tag == "" {
+		t.Fatalf("CacheTag: got %q, %v; want a tag", tag, err)
+	}
+	checkList(1, "a") // miss: the cache is empty
+	checkList(1, "a") // hit
+
+	create("b")
+	if next, err := cfg.CacheTag(); err != nil || next == tag {
+		t.Errorf("CacheTag after Create: got %q, %v; want a new tag", next, err)
+	}
+	checkList(2, "a", "b") // miss: the tag changed
+	checkList(2, "a", "b") // hit
+
+	if err := cfg.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	checkList(3, "b")
+}
+
+func TestPlan(t *testing.T) {
+	cfg := tarsnaptest.New(t.TempDir()).Config()
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"docs/a.txt": "apple\n", "db/dump.sql": "select 1;\n"})
+
+	plan := &tarsnap.Plan{Sets: []*tarsnap.BackupSet{{
+		Name:   "docs",
+		Create: tarsnap.CreateOptions{Include: []string{"docs"}, WorkDir: src},
+		Retain: &tarsnap.Policy{KeepLast: 1},
+	}, {
+		Name:   "broken",
+		Create: tarsnap.CreateOptions{Include: []string{"nonesuch"}, WorkDir: src},
+	}, {
+		Name:    "db",
+		Kind:    "hourly",
+		Archive: "{set}-{kind}.{time}",
+		Create:  tarsnap.CreateOptions{Include: []string{"db"}, WorkDir: src},
+	}}}
+	res, err := plan.Run(cfg)
+	if err == nil {
+		t.Error("Run: got nil error, want an error for the broken set")
+	}
+	stamp := res.Time.Format(tarsnap.DefaultTimeLayout)
+	var got []string
+	for _, sr := range res.Sets {
+		got = append(got, fmt.Sprintf("%s:%s:%v", sr.Set, sr.Archive, sr.Err != nil))
+	}
+	if diff := cmp.Diff([]string{
+		"docs:docs." + stamp + ":false",
+		"broken:broken." + stamp + ":true",
+		"db:db-hourly." + stamp + ":false",
+	}, got); diff != "" {
+		t.Errorf("Run results (-want, +got):\n%s", diff)
+	}
+
+	// Add an older archive of the docs set, and an unrelated archive that the
+	// plan does not manage.
+	older := res.Time.Add(-time.Hour)
+	for _, name := range []string{"docs." + older.Format(tarsnap.DefaultTimeLayout), "docs.manual"} {
+		if err := cfg.Create(name, tarsnap.CreateOptions{
+			Include: []string{"docs"}, WorkDir: src, CreationTime: older,
+		}); err != nil {
+			t.Fatalf("Create %q failed: %v", name, err)
+		}
+	}
+
+	reps, err := plan.Prune(cfg, false)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if len(reps) != 1 || reps[0].Set != "docs" || len(reps[0].Delete) != 1 {
+		t.Fatalf("Prune: got %+v, want one deletion from docs", reps)
+	}
+	lst, err := cfg.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	got = nil
+	for _, a := range lst {
+		got = append(got, a.Name)
+	}
+	if diff := cmp.Diff([]string{"docs.manual", "db-hourly." + stamp, "docs." + stamp}, got); diff != "" {
+		t.Errorf("List after Prune (-want, +got):\n%s", diff)
+	}
+}